@@ -6,12 +6,17 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/fluent/fluent-bit-go/output"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,6 +39,25 @@ type LogzioClient struct {
 	logger               *Logger
 	sizeThresholdInBytes int
 	headers              map[string]string
+	counters             *Counters
+	deadLetter           DeadLetterSink
+	// mu guards the bulk, which the interval flusher sends from its own goroutine
+	mu             sync.Mutex
+	bulkRecords    int
+	bulkStartedAt  time.Time
+	maxBulkRecords int
+	flushInterval  time.Duration
+	// intervalFailure is the result of a failed interval flush, returned by the next Flush so the chunk is retried
+	intervalFailed  bool
+	intervalFailure int
+	stopFlusher     chan struct{}
+	flusherDone     chan struct{}
+	closeOnce       sync.Once
+	shuttingDown    atomic.Bool
+	storagePath     string
+	// sendCtx is canceled when the shutdown deadline passes, to abort the requests in flight
+	sendCtx     context.Context
+	cancelSends context.CancelFunc
 }
 
 // ClientOptionFunc options for Logz.io
@@ -47,7 +71,9 @@ func NewClient(token string, options ...ClientOptionFunc) (*LogzioClient, error)
 		logger:               NewLogger(outputName, false),
 		sizeThresholdInBytes: defaultSizeThresholdMB * megaByte,
 		headers:              make(map[string]string),
+		counters:             NewCounters(),
 	}
+	logzioClient.sendCtx, logzioClient.cancelSends = context.WithCancel(context.Background())
 	tlsConfig := &tls.Config{}
 	transport := &http.Transport{
 		TLSClientConfig: tlsConfig,
@@ -70,6 +96,12 @@ func NewClient(token string, options ...ClientOptionFunc) (*LogzioClient, error)
 	logzioClient.logger.Debug(fmt.Sprintf("LogzioClient created. Using bulk size threshold: %d bytes (%d MB)",
 		logzioClient.sizeThresholdInBytes, logzioClient.sizeThresholdInBytes/megaByte))
 
+	if logzioClient.flushInterval > 0 {
+		logzioClient.stopFlusher = make(chan struct{})
+		logzioClient.flusherDone = make(chan struct{})
+		go logzioClient.runIntervalFlusher()
+	}
+
 	return logzioClient, nil
 }
 
@@ -80,6 +112,16 @@ func SetHeaders(headers map[string]string) ClientOptionFunc {
 	}
 }
 
+// SetLogger set the logger of the output instance that owns the client
+func SetLogger(logger *Logger) ClientOptionFunc {
+	return func(logzioClient *LogzioClient) error {
+		if logger != nil {
+			logzioClient.logger = logger
+		}
+		return nil
+	}
+}
+
 // SetURL set the url which maybe different from the defaultUrl
 func SetURL(listenerURL string) ClientOptionFunc {
 	return func(logzioClient *LogzioClient) error {
@@ -119,6 +161,58 @@ func SetBodySizeThresholdMB(thresholdMB int) ClientOptionFunc {
 	}
 }
 
+// SetFlushInterval set the maximum time a partially filled bulk waits before it is sent.
+// Zero disables the interval flush.
+func SetFlushInterval(interval time.Duration) ClientOptionFunc {
+	return func(logzioClient *LogzioClient) error {
+		if interval < 0 {
+			return fmt.Errorf("flush interval can't be negative: %s", interval)
+		}
+		logzioClient.flushInterval = interval
+		logzioClient.logger.Debug(fmt.Sprintf("setting flush interval to %s\n", interval))
+		return nil
+	}
+}
+
+// SetMaxBulkRecords set the maximum number of records in a bulk. Zero means no limit.
+func SetMaxBulkRecords(maxRecords int) ClientOptionFunc {
+	return func(logzioClient *LogzioClient) error {
+		if maxRecords < 0 {
+			return fmt.Errorf("max bulk records can't be negative: %d", maxRecords)
+		}
+		logzioClient.maxBulkRecords = maxRecords
+		logzioClient.logger.Debug(fmt.Sprintf("setting max bulk records to %d\n", maxRecords))
+		return nil
+	}
+}
+
+// SetStoragePath set a local directory where records that could not be sent at shutdown are persisted
+func SetStoragePath(path string) ClientOptionFunc {
+	return func(logzioClient *LogzioClient) error {
+		if path == "" {
+			return nil
+		}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return fmt.Errorf("failed to create storage directory %s: %w", path, err)
+		}
+		logzioClient.storagePath = path
+		logzioClient.logger.Debug(fmt.Sprintf("setting storage path to %s\n", path))
+		return nil
+	}
+}
+
+// SetDeadLetterPath set a local file that receives the records rejected by the listener
+func SetDeadLetterPath(path string) ClientOptionFunc {
+	return func(logzioClient *LogzioClient) error {
+		if path == "" {
+			return nil
+		}
+		logzioClient.deadLetter = newFileDeadLetterSink(path)
+		logzioClient.logger.Debug(fmt.Sprintf("setting dead letter path to %s\n", path))
+		return nil
+	}
+}
+
 // SetProxy set the http proxy url
 func SetProxy(proxyHost string, proxyUser string, proxyPass string) ClientOptionFunc {
 	return func(logzioClient *LogzioClient) error {
@@ -148,40 +242,74 @@ func SetProxy(proxyHost string, proxyUser string, proxyPass string) ClientOption
 
 // Send adds the log to the client bulk slice check if we should send the bulk
 func (logzioClient *LogzioClient) Send(log []byte) int {
+	if logzioClient.shuttingDown.Load() {
+		logzioClient.logger.Debug("client is shutting down, not accepting new records")
+		return output.FLB_RETRY
+	}
+	logzioClient.mu.Lock()
+	defer logzioClient.mu.Unlock()
+
 	// Logz.io maximum request body size is 10MB. We send bulks that
 	// exceed this size (with a safety buffer) via separate write requests.
 	if (len(logzioClient.bulk) + len(log) + 1) > logzioClient.sizeThresholdInBytes {
 		res := logzioClient.sendBulk()
-		logzioClient.bulk = nil
+		logzioClient.resetBulk()
 		if res != output.FLB_OK {
 			return res
 		}
 	}
 	logzioClient.logger.Debug(fmt.Sprintf("adding log to the bulk: %+v\n", string(log)))
+	if len(logzioClient.bulk) == 0 {
+		logzioClient.bulkStartedAt = time.Now()
+	}
 	logzioClient.bulk = append(logzioClient.bulk, log...)
 	logzioClient.bulk = append(logzioClient.bulk, '\n')
+	logzioClient.bulkRecords++
+
+	if logzioClient.maxBulkRecords > 0 && logzioClient.bulkRecords >= logzioClient.maxBulkRecords {
+		logzioClient.logger.Debug(fmt.Sprintf("bulk reached %d records, sending it", logzioClient.bulkRecords))
+		res := logzioClient.sendBulk()
+		logzioClient.resetBulk()
+		return res
+	}
 	return output.FLB_OK
 }
 
+func (logzioClient *LogzioClient) resetBulk() {
+	logzioClient.bulk = nil
+	logzioClient.bulkRecords = 0
+}
+
 func (logzioClient *LogzioClient) sendBulk() int {
+	return logzioClient.sendBulkWithContext(logzioClient.sendCtx)
+}
+
+func (logzioClient *LogzioClient) sendBulkWithContext(ctx context.Context) int {
 	if len(logzioClient.bulk) == 0 {
 		return output.FLB_OK
 	}
 
-	req, status := logzioClient.createRequest()
+	req, status := logzioClient.createRequest(ctx)
 	if status != output.FLB_OK {
+		logzioClient.counters.Add("records.failed", logzioClient.bulkRecords)
 		return status
 	}
 
-	respCode := logzioClient.doRequest(req)
+	respCode, rejectedLines := logzioClient.doRequest(req)
 	if respCode != output.FLB_OK {
+		logzioClient.counters.Add("records.failed", logzioClient.bulkRecords)
 		return logzioClient.shouldRetry(respCode)
 	}
 
+	if rejectedLines > logzioClient.bulkRecords {
+		rejectedLines = logzioClient.bulkRecords
+	}
+	logzioClient.counters.Add("records.sent", logzioClient.bulkRecords-rejectedLines)
+	logzioClient.counters.Add("records.rejected", rejectedLines)
 	return output.FLB_OK
 }
 
-func (logzioClient *LogzioClient) createRequest() (*http.Request, int) {
+func (logzioClient *LogzioClient) createRequest(ctx context.Context) (*http.Request, int) {
 	var buf bytes.Buffer
 	gzipWriter := gzip.NewWriter(&buf)
 
@@ -195,7 +323,7 @@ func (logzioClient *LogzioClient) createRequest() (*http.Request, int) {
 		return nil, output.FLB_RETRY
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/?token=%s", logzioClient.listenerURL, logzioClient.token), &buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/?token=%s", logzioClient.listenerURL, logzioClient.token), &buf)
 	if err != nil {
 		logzioClient.logger.Log(fmt.Sprintf("failed to create a request: %+v", err))
 		return nil, output.FLB_RETRY
@@ -211,11 +339,12 @@ func (logzioClient *LogzioClient) createRequest() (*http.Request, int) {
 	return req, output.FLB_OK
 }
 
-func (logzioClient *LogzioClient) doRequest(req *http.Request) int {
+// doRequest sends the request, and returns the result and the number of lines the listener rejected.
+func (logzioClient *LogzioClient) doRequest(req *http.Request) (int, int) {
 	resp, err := logzioClient.client.Do(req)
 	if err != nil {
 		logzioClient.logger.Log(fmt.Sprintf("failed to do retryable client request: %+v", err))
-		return output.FLB_RETRY
+		return output.FLB_RETRY, 0
 	}
 	defer resp.Body.Close()
 
@@ -224,12 +353,60 @@ func (logzioClient *LogzioClient) doRequest(req *http.Request) int {
 	if err != nil {
 		logzioClient.logger.Log(fmt.Sprintf("failed attempting to read from logz.io listener: %+v.  Status %v", err, resp.StatusCode))
 	}
+	// The listener reports lines it could not accept, either with a 2xx or a 400 status.
+	// Resending them can't succeed, and resending the bulk would duplicate the accepted lines.
+	rejectedLines := 0
+	if listenerResponse, err := parseListenerResponse(body); err == nil {
+		logzioClient.counters.Add("lines.successful", listenerResponse.SuccessfulLines)
+		if rejectedLines = listenerResponse.RejectedLines(); rejectedLines > 0 {
+			logzioClient.handleRejectedLines(listenerResponse)
+			if resp.StatusCode == http.StatusBadRequest && listenerResponse.SuccessfulLines > 0 {
+				return output.FLB_OK, rejectedLines
+			}
+		}
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		logzioClient.logger.Log(fmt.Sprintf("received a non-2xx HTTP status code from logz.io listener: %d (%v)", resp.StatusCode, string(body)))
-		return resp.StatusCode
+		return resp.StatusCode, 0
 	}
 	logzioClient.logger.Debug("successfully sent bulk to logz.io\n")
-	return output.FLB_OK
+	return output.FLB_OK, rejectedLines
+}
+
+func (logzioClient *LogzioClient) handleRejectedLines(listenerResponse *ListenerResponse) {
+	logzioClient.counters.Add("lines.malformed", listenerResponse.MalformedLines)
+	logzioClient.counters.Add("lines.oversized", listenerResponse.OversizedLines)
+	logzioClient.counters.Add("lines.empty", listenerResponse.EmptyLogLines)
+	logzioClient.logger.Warn(fmt.Sprintf("logz.io listener rejected %d lines (malformed: %d, oversized: %d, empty: %d, successful: %d)",
+		listenerResponse.RejectedLines(), listenerResponse.MalformedLines, listenerResponse.OversizedLines,
+		listenerResponse.EmptyLogLines, listenerResponse.SuccessfulLines))
+
+	rejected := classifyRejectedLines(logzioClient.bulk)
+	if unidentified := listenerResponse.RejectedLines() - len(rejected); unidentified > 0 {
+		// The other rejected lines look valid, so they can't be told apart from the accepted ones
+		logzioClient.counters.Add("lines.unidentified", unidentified)
+		logzioClient.logger.Warn(fmt.Sprintf("identified %d of %d rejected lines in the bulk. The other %d are not dead-lettered.",
+			len(rejected), listenerResponse.RejectedLines(), unidentified))
+	}
+
+	byReason := make(map[string][][]byte)
+	for i, rejectedLine := range rejected {
+		if i < maxRejectedSamples {
+			logzioClient.logger.Warn(fmt.Sprintf("rejected %s line sample: %s", rejectedLine.reason, rejectedSample(rejectedLine.line)))
+		}
+		byReason[rejectedLine.reason] = append(byReason[rejectedLine.reason], rejectedLine.line)
+	}
+
+	if logzioClient.deadLetter == nil {
+		return
+	}
+	for reason, lines := range byReason {
+		if err := logzioClient.deadLetter.Write(reason, lines); err != nil {
+			logzioClient.logger.Log(fmt.Sprintf("failed to write %d %s lines to dead letter sink: %+v", len(lines), reason, err))
+			continue
+		}
+		logzioClient.counters.Add("lines.dead_lettered", len(lines))
+	}
 }
 
 func (logzioClient *LogzioClient) shouldRetry(code int) int {
@@ -242,9 +419,148 @@ func (logzioClient *LogzioClient) shouldRetry(code int) int {
 	return output.FLB_ERROR
 }
 
-// Flush sends one last bulk
+// Flush sends one last bulk. It also returns the failure of an interval flush since the last Flush,
+// as the records of that bulk belong to the chunk being flushed.
 func (logzioClient *LogzioClient) Flush() int {
+	logzioClient.mu.Lock()
+	defer logzioClient.mu.Unlock()
 	resp := logzioClient.sendBulk()
-	logzioClient.bulk = nil
+	logzioClient.resetBulk()
+	// A retryable failure wins, so Fluent Bit retries the chunk
+	if logzioClient.intervalFailed && (resp == output.FLB_OK || logzioClient.intervalFailure == output.FLB_RETRY) {
+		resp = logzioClient.intervalFailure
+	}
+	logzioClient.intervalFailed = false
 	return resp
 }
+
+// runIntervalFlusher sends partially filled bulks once they are older than the flush interval.
+func (logzioClient *LogzioClient) runIntervalFlusher() {
+	defer close(logzioClient.flusherDone)
+	// Checking at a fraction of the interval bounds the extra latency to a quarter of it
+	tick := logzioClient.flushInterval / 4
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-logzioClient.stopFlusher:
+			return
+		case <-ticker.C:
+			logzioClient.flushExpiredBulk()
+		}
+	}
+}
+
+func (logzioClient *LogzioClient) flushExpiredBulk() {
+	logzioClient.mu.Lock()
+	defer logzioClient.mu.Unlock()
+	if len(logzioClient.bulk) == 0 || time.Since(logzioClient.bulkStartedAt) < logzioClient.flushInterval {
+		return
+	}
+	logzioClient.logger.Debug(fmt.Sprintf("flush interval of %s passed, sending bulk of %d records", logzioClient.flushInterval, logzioClient.bulkRecords))
+	if res := logzioClient.sendBulk(); res != output.FLB_OK {
+		logzioClient.logger.Log(fmt.Sprintf("interval flush of %d records failed with code %d, the chunk will be retried", logzioClient.bulkRecords, res))
+		if !logzioClient.intervalFailed || res == output.FLB_RETRY {
+			logzioClient.intervalFailed, logzioClient.intervalFailure = true, res
+		}
+	}
+	logzioClient.resetBulk()
+}
+
+// Close stops the interval flusher. Records still in the bulk are not sent.
+func (logzioClient *LogzioClient) Close() {
+	if logzioClient.stopFlusher == nil {
+		return
+	}
+	logzioClient.closeOnce.Do(func() { close(logzioClient.stopFlusher) })
+	<-logzioClient.flusherDone
+}
+
+// Shutdown stops accepting records and the interval flusher, then sends the pending bulk until ctx is done.
+// Records that could not be sent are persisted to the storage path when one is set, otherwise they are dropped.
+// It returns once the pending records are sent, persisted or dropped.
+func (logzioClient *LogzioClient) Shutdown(ctx context.Context) int {
+	logzioClient.shuttingDown.Store(true)
+
+	drained := make(chan int, 1)
+	go func() {
+		logzioClient.Close()
+		logzioClient.mu.Lock()
+		defer logzioClient.mu.Unlock()
+		res := logzioClient.sendBulkWithContext(ctx)
+		if res != output.FLB_OK {
+			logzioClient.persistBulk()
+		}
+		logzioClient.resetBulk()
+		logzioClient.client.CloseIdleConnections()
+		drained <- res
+	}()
+
+	select {
+	case res := <-drained:
+		return res
+	case <-ctx.Done():
+		logzioClient.logger.Log(fmt.Sprintf("drain deadline exceeded: %v. Canceling the requests in flight.", ctx.Err()))
+		// The canceled requests fail at once, so the drain persists the pending records before Fluent Bit exits
+		logzioClient.cancelSends()
+		<-drained
+		return output.FLB_ERROR
+	}
+}
+
+// persistBulk writes the pending bulk to the storage path. Must be called with mu held.
+func (logzioClient *LogzioClient) persistBulk() {
+	if len(logzioClient.bulk) == 0 {
+		return
+	}
+	if logzioClient.storagePath == "" {
+		logzioClient.logger.Log(fmt.Sprintf("dropping %d records that could not be sent", logzioClient.bulkRecords))
+		logzioClient.counters.Add("records.dropped", logzioClient.bulkRecords)
+		return
+	}
+
+	path := filepath.Join(logzioClient.storagePath, fmt.Sprintf("pending-%d.ndjson", time.Now().UnixNano()))
+	if err := os.WriteFile(path, logzioClient.bulk, 0600); err != nil {
+		logzioClient.logger.Log(fmt.Sprintf("failed to persist %d records to %s, dropping them: %+v", logzioClient.bulkRecords, path, err))
+		logzioClient.counters.Add("records.dropped", logzioClient.bulkRecords)
+		return
+	}
+	logzioClient.logger.Log(fmt.Sprintf("persisted %d records that could not be sent to %s", logzioClient.bulkRecords, path))
+	logzioClient.counters.Add("records.persisted", logzioClient.bulkRecords)
+}
+
+// HandOver closes the client in favor of next. Pending records move to next when both clients ship
+// to the same listener and token, otherwise they are sent (or persisted) to their original destination.
+func (logzioClient *LogzioClient) HandOver(next *LogzioClient) int {
+	logzioClient.shuttingDown.Store(true)
+	logzioClient.Close()
+	logzioClient.mu.Lock()
+	defer logzioClient.mu.Unlock()
+	defer logzioClient.client.CloseIdleConnections()
+
+	if len(logzioClient.bulk) == 0 {
+		return output.FLB_OK
+	}
+	if logzioClient.listenerURL != next.listenerURL || logzioClient.token != next.token {
+		res := logzioClient.sendBulk()
+		if res != output.FLB_OK {
+			logzioClient.persistBulk()
+		}
+		logzioClient.resetBulk()
+		return res
+	}
+
+	next.mu.Lock()
+	if len(next.bulk) == 0 {
+		next.bulkStartedAt = logzioClient.bulkStartedAt
+	}
+	next.bulk = append(logzioClient.bulk, next.bulk...)
+	next.bulkRecords += logzioClient.bulkRecords
+	next.mu.Unlock()
+	logzioClient.logger.Debug(fmt.Sprintf("handed over %d pending records", logzioClient.bulkRecords))
+	logzioClient.resetBulk()
+	return output.FLB_OK
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -131,6 +135,167 @@ func TestBulkSendingWithSmallThreshold(test *testing.T) {
 	require.GreaterOrEqual(test, receiveCount, 1) 
 }
 
+func TestPartialFailureResponse(test *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"malformedLines":1,"successfulLines":1,"oversizedLines":0,"emptyLogLines":0}`))
+	}))
+	defer testServer.Close()
+	deadLetterPath := filepath.Join(test.TempDir(), "dead_letter.log")
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetDeadLetterPath(deadLetterPath))
+	require.NoError(test, err)
+
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":"ok"}`)))
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":`)))
+	require.Equal(test, output.FLB_OK, logzioClient.Flush())
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.successful"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.malformed"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.dead_lettered"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("records.sent"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("records.rejected"))
+
+	deadLetters, err := os.ReadFile(deadLetterPath)
+	require.NoError(test, err)
+	lines := strings.Split(strings.TrimSpace(string(deadLetters)), "\n")
+	require.Len(test, lines, 1)
+	require.Contains(test, lines[0], `"reason":"malformed"`)
+	require.Contains(test, lines[0], `"record":"{\"message\":"`)
+}
+
+func TestUnidentifiedRejectedLinesResponse(test *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"malformedLines":2,"successfulLines":1,"oversizedLines":0,"emptyLogLines":0}`))
+	}))
+	defer testServer.Close()
+	deadLetterPath := filepath.Join(test.TempDir(), "dead_letter.log")
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetDeadLetterPath(deadLetterPath))
+	require.NoError(test, err)
+
+	// The listener rejected one of the valid JSON lines, which can't be told apart from the accepted one
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":"first"}`)))
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":"second"}`)))
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":`)))
+	require.Equal(test, output.FLB_OK, logzioClient.Flush())
+	require.Equal(test, uint64(1), logzioClient.counters.Get("records.sent"))
+	require.Equal(test, uint64(2), logzioClient.counters.Get("records.rejected"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.unidentified"))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.dead_lettered"))
+
+	deadLetters, err := os.ReadFile(deadLetterPath)
+	require.NoError(test, err)
+	lines := strings.Split(strings.TrimSpace(string(deadLetters)), "\n")
+	require.Len(test, lines, 1)
+	require.Contains(test, lines[0], `"reason":"malformed"`)
+}
+
+func TestAllLinesRejectedResponse(test *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"malformedLines":1,"successfulLines":0,"oversizedLines":0,"emptyLogLines":0}`))
+	}))
+	defer testServer.Close()
+	logzioClient := LogzioTestClient(testServer.URL)
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":`)))
+	require.Equal(test, output.FLB_ERROR, logzioClient.Flush())
+	require.Equal(test, uint64(1), logzioClient.counters.Get("lines.malformed"))
+}
+
+func TestIntervalFlush(test *testing.T) {
+	received := make(chan []string, 1)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logs, err := readLogs(r)
+		require.NoError(test, err)
+		received <- logs
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetFlushInterval(50*time.Millisecond))
+	require.NoError(test, err)
+	defer logzioClient.Close()
+
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte("interval")))
+	select {
+	case logs := <-received:
+		require.Equal(test, []string{"interval"}, logs)
+	case <-time.After(2 * time.Second):
+		test.Fatal("partial bulk was not sent after the flush interval")
+	}
+	require.Equal(test, output.FLB_OK, logzioClient.Flush())
+}
+
+func TestIntervalFlushFailureIsReturnedByFlush(test *testing.T) {
+	requests := make(chan struct{}, 1)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		requests <- struct{}{}
+	}))
+	defer testServer.Close()
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetFlushInterval(50*time.Millisecond))
+	require.NoError(test, err)
+	defer logzioClient.Close()
+
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte("interval")))
+	select {
+	case <-requests:
+	case <-time.After(2 * time.Second):
+		test.Fatal("partial bulk was not sent after the flush interval")
+	}
+	// The chunk of the failed bulk must be retried
+	require.Eventually(test, func() bool {
+		logzioClient.mu.Lock()
+		defer logzioClient.mu.Unlock()
+		return logzioClient.intervalFailed
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(test, output.FLB_RETRY, logzioClient.Flush())
+	require.Equal(test, output.FLB_OK, logzioClient.Flush())
+	require.Zero(test, logzioClient.counters.Get("records.dropped"))
+}
+
+func TestMaxBulkRecords(test *testing.T) {
+	var bulks [][]string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logs, err := readLogs(r)
+		require.NoError(test, err)
+		bulks = append(bulks, logs)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetMaxBulkRecords(2))
+	require.NoError(test, err)
+
+	for i := 1; i <= 3; i++ {
+		require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(fmt.Sprintf("log %d", i))))
+	}
+	require.Len(test, bulks, 1)
+	require.Equal(test, output.FLB_OK, logzioClient.Flush())
+	require.Equal(test, [][]string{{"log 1", "log 2"}, {"log 3"}}, bulks)
+}
+
+func TestShutdownPersistsPendingRecords(test *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testServer.Close()
+	storagePath := test.TempDir()
+	logzioClient, err := NewClient(logzioTestToken, SetURL(testServer.URL), SetStoragePath(storagePath))
+	require.NoError(test, err)
+	require.Equal(test, output.FLB_OK, logzioClient.Send([]byte(`{"message":"pending"}`)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.Equal(test, output.FLB_RETRY, logzioClient.Shutdown(ctx))
+	require.Equal(test, uint64(1), logzioClient.counters.Get("records.persisted"))
+	require.Equal(test, output.FLB_RETRY, logzioClient.Send([]byte(`{"message":"late"}`)))
+
+	files, err := filepath.Glob(filepath.Join(storagePath, "pending-*.ndjson"))
+	require.NoError(test, err)
+	require.Len(test, files, 1)
+	persisted, err := os.ReadFile(files[0])
+	require.NoError(test, err)
+	require.Equal(test, "{\"message\":\"pending\"}\n", string(persisted))
+}
+
 func readLogs(r *http.Request) ([]string, error) {
 	gzipReader, err := gzip.NewReader(r.Body)
 	if err != nil {
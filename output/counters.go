@@ -0,0 +1,72 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counters is a set of named, monotonically increasing counters.
+// It is safe for concurrent use, and a nil *Counters ignores updates.
+type Counters struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounters is the constructor for an empty counter set.
+func NewCounters() *Counters {
+	return &Counters{values: make(map[string]uint64)}
+}
+
+// Add increases the named counter by delta. Non-positive deltas are ignored.
+func (c *Counters) Add(name string, delta int) {
+	if c == nil || delta <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.values[name] += uint64(delta)
+	c.mu.Unlock()
+}
+
+// Get returns the current value of the named counter.
+func (c *Counters) Get(name string) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[name]
+}
+
+// Snapshot returns a copy of all counters.
+func (c *Counters) Snapshot() map[string]uint64 {
+	if c == nil {
+		return map[string]uint64{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]uint64, len(c.values))
+	for name, value := range c.values {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// String formats the counters as sorted "name=value" pairs.
+func (c *Counters) String() string {
+	snapshot := c.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, snapshot[name]))
+	}
+	return strings.Join(pairs, ", ")
+}
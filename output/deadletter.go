@@ -0,0 +1,63 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// DeadLetterSink receives records that Logz.io will not accept.
+type DeadLetterSink interface {
+	Write(reason string, records [][]byte) error
+}
+
+// fileDeadLetterSink appends dead-lettered records to a local file, one JSON object per line.
+type fileDeadLetterSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+type deadLetterEntry struct {
+	Timestamp string `json:"@timestamp"`
+	Reason    string `json:"reason"`
+	Record    string `json:"record"`
+}
+
+func newFileDeadLetterSink(path string) *fileDeadLetterSink {
+	return &fileDeadLetterSink{path: path}
+}
+
+func (sink *fileDeadLetterSink) Write(reason string, records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var lines []byte
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, record := range records {
+		line, err := jsoniter.Marshal(deadLetterEntry{Timestamp: now, Reason: reason, Record: string(record)})
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead letter entry: %w", err)
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file %s: %w", sink.path, err)
+	}
+	if _, err := file.Write(lines); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write dead letter file %s: %w", sink.path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,219 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// eventOK, eventEnd and eventMalformed are the return codes of Plugin.GetRecord.
+	eventOK        = 0
+	eventEnd       = -1
+	eventMalformed = -2
+
+	// eventTimeExtType is the msgpack extension type of the Fluent Bit EventTime.
+	eventTimeExtType = 0
+
+	// Group markers have these timestamps in the event header, as integers or as the signed 32 bit seconds
+	// of an EventTime, and their record holds the group attributes.
+	groupStartMarker = -1
+	groupEndMarker   = -2
+)
+
+// logEvent is a record of a Fluent Bit chunk. Chunks use [ts, record] entries, or [[ts, metadata], record]
+// entries since Fluent Bit v2.1.
+type logEvent struct {
+	timestamp interface{}
+	metadata  map[interface{}]interface{}
+	record    map[interface{}]interface{}
+	// raw is the msgpack encoded record. record is nil while the decoder leaves it encoded.
+	raw []byte
+	// group holds the attributes of the group the record belongs to, e.g. the OTLP resource and scope.
+	group map[interface{}]interface{}
+}
+
+// eventTime is the EventTime extension, 32 bits of seconds and 32 bits of nanoseconds.
+type eventTime struct {
+	time.Time
+	valid bool
+	// marker is the group marker of the seconds, or zero.
+	marker int64
+}
+
+func (ext *eventTime) WriteExt(interface{}) []byte {
+	panic("unsupported")
+}
+
+func (ext *eventTime) ReadExt(dst interface{}, data []byte) {
+	out := dst.(*eventTime)
+	if len(data) != 8 {
+		return
+	}
+	seconds := binary.BigEndian.Uint32(data)
+	nanos := binary.BigEndian.Uint32(data[4:])
+	out.Time, out.valid = time.Unix(int64(seconds), int64(nanos)), true
+	if marker := int64(int32(seconds)); marker == groupStartMarker || marker == groupEndMarker {
+		out.marker = marker
+	}
+}
+
+// eventDecoder decodes the events of a Fluent Bit chunk and keeps track of the group they belong to.
+type eventDecoder struct {
+	reader  msgpackReader
+	decoder *codec.Decoder
+	group   map[interface{}]interface{}
+	// lazy leaves the records and the metadata encoded, for the record transcoder.
+	lazy bool
+}
+
+func newEventHandle() *codec.MsgpackHandle {
+	handle := new(codec.MsgpackHandle)
+	handle.RawToString = true
+	handle.SetBytesExt(reflect.TypeOf(eventTime{}), eventTimeExtType, &eventTime{})
+	return handle
+}
+
+var eventHandle = newEventHandle()
+
+func newEventDecoder(data []byte) *eventDecoder {
+	return &eventDecoder{reader: msgpackReader{data: data}, decoder: codec.NewDecoderBytes(nil, eventHandle)}
+}
+
+// next returns the next record, consuming group markers. It returns io.EOF at the end of the chunk.
+// An entry that is not an event returns an error, and the records after it can still be read.
+func (decoder *eventDecoder) next() (logEvent, error) {
+	for {
+		if decoder.reader.done() {
+			return logEvent{}, io.EOF
+		}
+		start := decoder.reader.pos
+		if err := decoder.reader.skip(); err != nil {
+			// The rest of the chunk can't be read past an entry that is truncated or not msgpack
+			decoder.reader.pos = len(decoder.reader.data)
+			return logEvent{}, io.EOF
+		}
+
+		event, marker, err := decoder.decodeEntry(decoder.reader.data[start:decoder.reader.pos])
+		if err != nil {
+			return logEvent{}, err
+		}
+		switch marker {
+		case groupStartMarker:
+			if decoder.group, err = decoder.decodeMap(event.raw); err != nil {
+				return logEvent{}, err
+			}
+		case groupEndMarker:
+			decoder.group = nil
+		default:
+			event.group = decoder.group
+			if !decoder.lazy {
+				if event.record, err = decoder.decodeMap(event.raw); err != nil {
+					return logEvent{}, err
+				}
+			}
+			return event, nil
+		}
+	}
+}
+
+// decodeEntry reads the header of a [header, record] chunk entry. marker is the group marker of the entry,
+// or zero for a record.
+func (decoder *eventDecoder) decodeEntry(entry []byte) (event logEvent, marker int64, err error) {
+	reader := msgpackReader{data: entry}
+	token, err := reader.next()
+	if err != nil || token.kind != msgpackArray || token.length != 2 {
+		return event, 0, fmt.Errorf("expected a [header, record] array")
+	}
+	headerStart := reader.pos
+	if err := reader.skip(); err != nil {
+		return event, 0, err
+	}
+	header := msgpackReader{data: entry[headerStart:reader.pos]}
+	event.raw = entry[reader.pos:]
+	if !isMsgpackMap(event.raw) {
+		return event, 0, fmt.Errorf("expected a record map")
+	}
+
+	timestamp, err := header.next()
+	if err != nil {
+		return event, 0, err
+	}
+	if timestamp.kind == msgpackArray {
+		length := timestamp.length
+		if length < 1 {
+			return event, 0, fmt.Errorf("empty event header")
+		}
+		if timestamp, err = header.next(); err != nil {
+			return event, 0, err
+		}
+		if length > 1 && timestamp.kind != msgpackArray && timestamp.kind != msgpackMap && !decoder.lazy {
+			metadata := header.data[header.pos:]
+			if isMsgpackMap(metadata) && metadata[0] != 0x80 {
+				if event.metadata, err = decoder.decodeMap(metadata); err != nil {
+					return event, 0, err
+				}
+			}
+		}
+	}
+
+	switch timestamp.kind {
+	case msgpackExt:
+		if timestamp.extType != eventTimeExtType {
+			return event, 0, fmt.Errorf("unsupported event time extension %d", timestamp.extType)
+		}
+		var t eventTime
+		t.ReadExt(&t, timestamp.bytes)
+		if !t.valid {
+			return event, 0, fmt.Errorf("malformed event time")
+		}
+		if t.marker != 0 {
+			return event, t.marker, nil
+		}
+		event.timestamp = t.Time
+	case msgpackInt:
+		if timestamp.int == groupStartMarker || timestamp.int == groupEndMarker {
+			return event, timestamp.int, nil
+		}
+		event.timestamp = timestamp.int
+	case msgpackUint:
+		event.timestamp = timestamp.uint
+	case msgpackFloat:
+		event.timestamp = timestamp.float
+	default:
+		return event, 0, fmt.Errorf("unsupported event time")
+	}
+	return event, 0, nil
+}
+
+// decodeMap decodes an encoded map, e.g. the raw record of an event.
+func (decoder *eventDecoder) decodeMap(data []byte) (map[interface{}]interface{}, error) {
+	var decoded map[interface{}]interface{}
+	decoder.decoder.ResetBytes(data)
+	if err := decoder.decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// attachEventMetadata adds the metadata and the group attributes of the event to its record,
+// under the configured keys.
+func (instance *LogzioOutput) attachEventMetadata(event logEvent) {
+	if instance.metadataKey != "" && len(event.metadata) > 0 {
+		if _, exists := event.record[instance.metadataKey]; !exists {
+			event.record[instance.metadataKey] = event.metadata
+		}
+	}
+	if instance.groupKey != "" && len(event.group) > 0 {
+		if _, exists := event.record[instance.groupKey]; !exists {
+			event.record[instance.groupKey] = event.group
+		}
+	}
+}
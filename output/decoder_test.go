@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func testEventTime(seconds int32, nanos uint32) codec.RawExt {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(seconds))
+	binary.BigEndian.PutUint32(data[4:], nanos)
+	return codec.RawExt{Tag: eventTimeExtType, Data: data}
+}
+
+func encodeTestChunk(test testing.TB, entries ...interface{}) []byte {
+	handle := new(codec.MsgpackHandle)
+	handle.WriteExt = true
+	var chunk []byte
+	encoder := codec.NewEncoderBytes(&chunk, handle)
+	for _, entry := range entries {
+		require.NoError(test, encoder.Encode(entry))
+	}
+	return chunk
+}
+
+func TestEventDecoder(test *testing.T) {
+	chunk := encodeTestChunk(test,
+		// Fluent Bit v1 event
+		[]interface{}{testEventTime(1709647629, 5), map[string]interface{}{"message": "v1"}},
+		// Forward protocol event with integer seconds
+		[]interface{}{uint64(1709647630), map[string]interface{}{"message": "seconds"}},
+		// Group with OTLP attributes
+		[]interface{}{[]interface{}{testEventTime(groupStartMarker, 0), map[string]interface{}{"schema": "otlp"}},
+			map[string]interface{}{"resource": map[string]interface{}{"service.name": "checkout"}}},
+		[]interface{}{[]interface{}{testEventTime(1709647631, 0), map[string]interface{}{"otlp": map[string]interface{}{"trace_id": "abc"}}},
+			map[string]interface{}{"message": "grouped"}},
+		"not an event",
+		[]interface{}{[]interface{}{int64(groupEndMarker), map[string]interface{}{}}, map[string]interface{}{}},
+		[]interface{}{[]interface{}{testEventTime(1709647632, 0), map[string]interface{}{}}, map[string]interface{}{"message": "v2"}},
+	)
+	decoder := newEventDecoder(chunk)
+
+	event, err := decoder.next()
+	require.NoError(test, err)
+	require.Equal(test, time.Unix(1709647629, 5), event.timestamp)
+	require.Equal(test, "v1", event.record["message"])
+	require.Nil(test, event.metadata)
+
+	event, err = decoder.next()
+	require.NoError(test, err)
+	require.Equal(test, uint64(1709647630), event.timestamp)
+
+	event, err = decoder.next()
+	require.NoError(test, err)
+	require.Equal(test, "grouped", event.record["message"])
+	require.Equal(test, time.Unix(1709647631, 0), event.timestamp)
+	require.Contains(test, event.metadata, "otlp")
+	require.Contains(test, event.group, "resource")
+
+	_, err = decoder.next()
+	require.Error(test, err)
+	require.NotEqual(test, io.EOF, err)
+
+	event, err = decoder.next()
+	require.NoError(test, err)
+	require.Equal(test, "v2", event.record["message"])
+	require.Nil(test, event.group)
+
+	_, err = decoder.next()
+	require.Equal(test, io.EOF, err)
+}
+
+func TestEventDecoderMalformed(test *testing.T) {
+	decoder := newEventDecoder(encodeTestChunk(test,
+		[]interface{}{codec.RawExt{Tag: eventTimeExtType, Data: []byte{1, 2}}, map[string]interface{}{}},
+		[]interface{}{"time", map[string]interface{}{}},
+		[]interface{}{[]interface{}{}, map[string]interface{}{}},
+		[]interface{}{uint64(1), "record"},
+	))
+	for i := 0; i < 4; i++ {
+		_, err := decoder.next()
+		require.Error(test, err)
+		require.NotEqual(test, io.EOF, err)
+	}
+	_, err := decoder.next()
+	require.Equal(test, io.EOF, err)
+
+	// A truncated chunk ends the decoding
+	chunk := encodeTestChunk(test, []interface{}{uint64(1), map[string]interface{}{"message": "truncated"}})
+	_, err = newEventDecoder(chunk[:len(chunk)-3]).next()
+	require.Equal(test, io.EOF, err)
+}
+
+func TestAttachEventMetadata(test *testing.T) {
+	instance := &LogzioOutput{metadataKey: "metadata", groupKey: "group"}
+	event := logEvent{
+		metadata: map[interface{}]interface{}{"trace_id": "abc"},
+		group:    map[interface{}]interface{}{"resource": "r"},
+		record:   map[interface{}]interface{}{"message": "m", "group": "kept"},
+	}
+	instance.attachEventMetadata(event)
+	require.Equal(test, event.metadata, event.record["metadata"])
+	require.Equal(test, "kept", event.record["group"])
+
+	record := map[interface{}]interface{}{"message": "m"}
+	(&LogzioOutput{}).attachEventMetadata(logEvent{metadata: event.metadata, record: record})
+	require.Len(test, record, 1)
+}
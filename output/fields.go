@@ -0,0 +1,125 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lookupField returns the value at a dotted path of nested maps, e.g. "kubernetes.labels.app".
+// Keys that contain dots themselves, like "app.kubernetes.io/name", are matched as well.
+func lookupField(body map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := body[path]; ok {
+		return value, true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := body[path[:i]].(map[string]interface{}); ok {
+			if value, ok := lookupField(nested, path[i+1:]); ok {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// setField sets the value at a dotted path, creating the nested maps on the way.
+// When overwrite is false, existing values are kept. It reports whether the value was set.
+func setField(body map[string]interface{}, path string, value interface{}, overwrite bool) bool {
+	segments := strings.Split(path, ".")
+	current := body
+	for _, segment := range segments[:len(segments)-1] {
+		existing, found := current[segment]
+		nested, isMap := existing.(map[string]interface{})
+		if !isMap {
+			if found && !overwrite {
+				return false
+			}
+			nested = make(map[string]interface{})
+			current[segment] = nested
+		}
+		current = nested
+	}
+	last := segments[len(segments)-1]
+	if _, found := current[last]; found && !overwrite {
+		return false
+	}
+	current[last] = value
+	return true
+}
+
+// addedField is a static field injected to every record.
+type addedField struct {
+	path  string
+	value string
+}
+
+// parseAddedFields parses a "key1:value1,key2:value2" list, expanding ${VAR} environment variables in the values.
+func parseAddedFields(config string, logger *Logger) []addedField {
+	var fields []addedField
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			if strings.TrimSpace(pair) != "" {
+				logger.Warn(fmt.Sprintf("Warning: malformed field '%s' in logzio_add_fields. Expected format 'key:value'", pair))
+			}
+			continue
+		}
+		fields = append(fields, addedField{
+			path:  strings.TrimSpace(parts[0]),
+			value: os.ExpandEnv(strings.TrimSpace(parts[1])),
+		})
+	}
+	return fields
+}
+
+// addFields injects the configured static fields to the record body.
+func (instance *LogzioOutput) addFields(body map[string]interface{}) {
+	for _, field := range instance.addedFields {
+		setField(body, field.path, field.value, instance.addFieldsOverwrite)
+	}
+}
+
+// removeField deletes the value at a dotted path and returns it. Parent maps left empty are removed as well.
+func removeField(body map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := body[path]; ok {
+		delete(body, path)
+		return value, true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := body[path[:i]].(map[string]interface{}); ok {
+			if value, ok := removeField(nested, path[i+1:]); ok {
+				if len(nested) == 0 {
+					delete(body, path[:i])
+				}
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// replaceField sets the value of an existing field at a dotted path, using the same path resolution as lookupField.
+func replaceField(body map[string]interface{}, path string, value interface{}) bool {
+	if _, ok := body[path]; ok {
+		body[path] = value
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := body[path[:i]].(map[string]interface{}); ok && replaceField(nested, path[i+1:], value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupField(test *testing.T) {
+	body := map[string]interface{}{
+		"message": "hello",
+		"kubernetes": map[string]interface{}{
+			"labels": map[string]interface{}{"app.kubernetes.io/name": "checkout"},
+		},
+	}
+	value, ok := lookupField(body, "kubernetes.labels.app.kubernetes.io/name")
+	require.True(test, ok)
+	require.Equal(test, "checkout", value)
+	_, ok = lookupField(body, "message.nested")
+	require.False(test, ok)
+}
+
+func TestSetField(test *testing.T) {
+	body := map[string]interface{}{"cluster": "existing", "meta": "scalar"}
+	require.True(test, setField(body, "env.region", "us-east-1", false))
+	require.False(test, setField(body, "cluster", "new", false))
+	require.False(test, setField(body, "meta.build", "42", false))
+	require.True(test, setField(body, "meta.build", "42", true))
+	require.Equal(test, map[string]interface{}{
+		"cluster": "existing",
+		"env":     map[string]interface{}{"region": "us-east-1"},
+		"meta":    map[string]interface{}{"build": "42"},
+	}, body)
+}
+
+func TestAddFields(test *testing.T) {
+	test.Setenv("TEST_CLUSTER_NAME", "prod-eu")
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":      testToken,
+		"id":                testId,
+		"logzio_add_fields": "cluster:${TEST_CLUSTER_NAME}, environment:production, deploy.build_id:b-17, malformed",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+	require.Len(test, instance.addedFields, 3)
+
+	record := map[interface{}]interface{}{"message": "hello", "environment": "staging"}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "prod-eu", result["cluster"])
+	require.Equal(test, "staging", result["environment"])
+	require.Equal(test, map[string]interface{}{"build_id": "b-17"}, result["deploy"])
+
+	instance.addFieldsOverwrite = true
+	serialized, err = serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "production", result["environment"])
+}
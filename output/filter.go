@@ -0,0 +1,92 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import "strings"
+
+// fieldFilter keeps or removes record fields by dotted path patterns, e.g. "request.headers" or "kubernetes.*_hash".
+// A '*' matches any sequence of characters within a single path segment.
+type fieldFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+// newFieldFilter parses comma separated include and exclude lists. It returns nil when both are empty.
+func newFieldFilter(include string, exclude string) *fieldFilter {
+	filter := &fieldFilter{
+		include: parseFieldPatterns(include),
+		exclude: parseFieldPatterns(exclude),
+	}
+	if len(filter.include) == 0 && len(filter.exclude) == 0 {
+		return nil
+	}
+	return filter
+}
+
+func parseFieldPatterns(config string) [][]string {
+	var patterns [][]string
+	for _, pattern := range strings.Split(config, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, strings.Split(pattern, "."))
+		}
+	}
+	return patterns
+}
+
+func (filter *fieldFilter) hasIncludes() bool {
+	return filter != nil && len(filter.include) > 0
+}
+
+// excluded reports whether the field at path matches an exclude pattern.
+func (filter *fieldFilter) excluded(path []string) bool {
+	for _, pattern := range filter.exclude {
+		if len(pattern) == len(path) && matchSegments(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// inclusion reports whether the field at path is included, by itself or by one of its parents,
+// or whether it is only an ancestor of included fields.
+func (filter *fieldFilter) inclusion(path []string) (included bool, ancestor bool) {
+	for _, pattern := range filter.include {
+		if len(pattern) <= len(path) && matchSegments(pattern, path[:len(pattern)]) {
+			return true, false
+		}
+		if len(pattern) > len(path) && matchSegments(pattern[:len(path)], path) {
+			ancestor = true
+		}
+	}
+	return false, ancestor
+}
+
+func matchSegments(patterns []string, segments []string) bool {
+	for i, pattern := range patterns {
+		if !matchWildcard(pattern, segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchWildcard matches a string against a pattern where '*' matches any sequence of characters.
+func matchWildcard(pattern string, value string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, pattern[:star]) {
+		return false
+	}
+	value = value[star:]
+	pattern = pattern[star+1:]
+	for i := 0; i <= len(value); i++ {
+		if matchWildcard(pattern, value[i:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchWildcard(test *testing.T) {
+	require.True(test, matchWildcard("*", "anything"))
+	require.True(test, matchWildcard("pod-*-hash", "pod-template-hash"))
+	require.True(test, matchWildcard("x-*", "x-"))
+	require.False(test, matchWildcard("x-*", "y-request-id"))
+	require.False(test, matchWildcard("pod", "pod-name"))
+}
+
+func TestParseJSONExcludeFields(test *testing.T) {
+	record := map[interface{}]interface{}{
+		"message": "hello",
+		"request": map[interface{}]interface{}{
+			"method":  "GET",
+			"headers": map[interface{}]interface{}{"cookie": "secret"},
+		},
+		"kubernetes": map[interface{}]interface{}{
+			"labels": map[interface{}]interface{}{"app": "checkout", "pod-template-hash": "abc"},
+		},
+		"items": []interface{}{
+			map[interface{}]interface{}{"id": 1, "debug": "x"},
+		},
+	}
+	parser := &recordParser{filter: newFieldFilter("", "request.headers, kubernetes.labels.*-hash, items.debug")}
+	body := parseJSON(record, parser)
+	require.Equal(test, map[string]interface{}{
+		"message":    "hello",
+		"request":    map[string]interface{}{"method": "GET"},
+		"kubernetes": map[string]interface{}{"labels": map[string]interface{}{"app": "checkout"}},
+		"items":      []interface{}{map[string]interface{}{"id": 1}},
+	}, body)
+	require.Equal(test, 3, parser.removedFields)
+}
+
+func TestParseJSONIncludeFields(test *testing.T) {
+	record := map[interface{}]interface{}{
+		"message": "hello",
+		"level":   "info",
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": "payments",
+			"pod_name":       "checkout-1",
+			"labels":         map[interface{}]interface{}{"app": "checkout", "pod-template-hash": "abc"},
+			"annotations":    map[interface{}]interface{}{"a": "b"},
+		},
+	}
+	parser := &recordParser{filter: newFieldFilter("message, kubernetes.*_name, kubernetes.labels", "kubernetes.labels.pod-template-hash")}
+	body := parseJSON(record, parser)
+	require.Equal(test, map[string]interface{}{
+		"message": "hello",
+		"kubernetes": map[string]interface{}{
+			"namespace_name": "payments",
+			"pod_name":       "checkout-1",
+			"labels":         map[string]interface{}{"app": "checkout"},
+		},
+	}, body)
+	require.Equal(test, 3, parser.removedFields)
+}
@@ -0,0 +1,115 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	defaultFlattenSeparator = "."
+
+	flattenArraysKeep      = "keep"
+	flattenArraysIndex     = "index"
+	flattenArraysStringify = "stringify"
+)
+
+// flattener turns nested objects into single level keys joined by a separator, e.g. {"a":{"b":1}} to {"a.b":1}.
+type flattener struct {
+	separator string
+	// maxDepth is the number of nested levels to flatten. Deeper objects are kept as they are. Zero means no limit.
+	maxDepth int
+	arrays   string
+}
+
+func newFlattener(separator string, maxDepth int, arrays string, logger *Logger) *flattener {
+	flattener := &flattener{separator: separator, maxDepth: maxDepth, arrays: flattenArraysKeep}
+	if flattener.separator == "" {
+		flattener.separator = defaultFlattenSeparator
+	}
+	if flattener.maxDepth < 0 {
+		logger.Warn(fmt.Sprintf("Invalid logzio_flatten_max_depth value (%d). Flattening all levels.", maxDepth))
+		flattener.maxDepth = 0
+	}
+	switch arrays {
+	case "", flattenArraysKeep:
+	case flattenArraysIndex, flattenArraysStringify:
+		flattener.arrays = arrays
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_flatten_arrays value '%s'. Using default: %s.", arrays, flattenArraysKeep))
+	}
+	return flattener
+}
+
+// flatten returns a single level copy of the record body.
+func (flattener *flattener) flatten(body map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{}, len(body))
+	flattener.flattenMap(flat, "", body, 1)
+	return flat
+}
+
+// flattenMap writes the values that stay as they are before the nested ones, and the nested ones in key order,
+// so the first value written for a key is the same for every record.
+func (flattener *flattener) flattenMap(flat map[string]interface{}, prefix string, nested map[string]interface{}, depth int) {
+	var expanded []string
+	for key, value := range nested {
+		if flattener.expands(value, depth) {
+			expanded = append(expanded, key)
+			continue
+		}
+		flattener.flattenValue(flat, flattener.join(prefix, key), value, depth)
+	}
+	sort.Strings(expanded)
+	for _, key := range expanded {
+		flattener.flattenValue(flat, flattener.join(prefix, key), nested[key], depth)
+	}
+}
+
+func (flattener *flattener) join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + flattener.separator + key
+}
+
+// expands reports whether the value at depth is flattened into more keys.
+func (flattener *flattener) expands(value interface{}, depth int) bool {
+	if flattener.maxDepth != 0 && depth > flattener.maxDepth {
+		return false
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return flattener.arrays == flattenArraysIndex
+	}
+	return false
+}
+
+func (flattener *flattener) flattenValue(flat map[string]interface{}, key string, value interface{}, depth int) {
+	if flattener.expands(value, depth) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattener.flattenMap(flat, key, v, depth+1)
+		case []interface{}:
+			for i, element := range v {
+				flattener.flattenValue(flat, key+flattener.separator+strconv.Itoa(i), element, depth+1)
+			}
+		}
+		return
+	}
+	if v, isArray := value.([]interface{}); isArray && flattener.arrays == flattenArraysStringify {
+		if stringified, err := jsoniter.MarshalToString(v); err == nil {
+			value = stringified
+		}
+	}
+	// The first value wins, so a key that exists in the record with the same name as a flattened key is kept
+	if _, exists := flat[key]; !exists {
+		flat[key] = value
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFlattenBody() map[string]interface{} {
+	return map[string]interface{}{
+		"message": "hello",
+		"kubernetes": map[string]interface{}{
+			"labels": map[string]interface{}{"app": "checkout"},
+			"pod":    "checkout-1",
+		},
+		"tags":  []interface{}{"a", map[string]interface{}{"b": 1}},
+		"empty": map[string]interface{}{},
+	}
+}
+
+func TestFlatten(test *testing.T) {
+	logger := NewLogger("testFlatten", false)
+
+	flat := newFlattener("", 0, "", logger).flatten(newTestFlattenBody())
+	require.Equal(test, map[string]interface{}{
+		"message":               "hello",
+		"kubernetes.labels.app": "checkout",
+		"kubernetes.pod":        "checkout-1",
+		"tags":                  []interface{}{"a", map[string]interface{}{"b": 1}},
+		"empty":                 map[string]interface{}{},
+	}, flat)
+
+	flat = newFlattener("_", 1, flattenArraysIndex, logger).flatten(newTestFlattenBody())
+	require.Equal(test, map[string]interface{}{
+		"message":           "hello",
+		"kubernetes_labels": map[string]interface{}{"app": "checkout"},
+		"kubernetes_pod":    "checkout-1",
+		"tags_0":            "a",
+		"tags_1":            map[string]interface{}{"b": 1},
+		"empty":             map[string]interface{}{},
+	}, flat)
+
+	flat = newFlattener(".", 0, flattenArraysStringify, logger).flatten(newTestFlattenBody())
+	require.Equal(test, `["a",{"b":1}]`, flat["tags"])
+
+	require.Equal(test, flattenArraysKeep, newFlattener(".", 0, "invalid", logger).arrays)
+}
+
+func TestFlattenCollisions(test *testing.T) {
+	flattener := newFlattener("", 0, flattenArraysIndex, NewLogger("testFlatten", false))
+	for i := 0; i < 100; i++ {
+		flat := flattener.flatten(map[string]interface{}{
+			"a.b":    "record",
+			"a":      map[string]interface{}{"b": "nested", "c": "kept"},
+			"x.y.z":  "first",
+			"x":      map[string]interface{}{"y.z": "second", "y": map[string]interface{}{"z": "third"}},
+			"tags.0": "record",
+			"tags":   []interface{}{"element"},
+		})
+		require.Equal(test, map[string]interface{}{
+			"a.b":    "record",
+			"a.c":    "kept",
+			"x.y.z":  "first",
+			"tags.0": "record",
+		}, flat)
+
+		// Between nested objects, the one with the lower key wins
+		flat = flattener.flatten(map[string]interface{}{
+			"p":   map[string]interface{}{"q.r": "p"},
+			"p.q": map[string]interface{}{"r": "p.q"},
+		})
+		require.Equal(test, map[string]interface{}{"p.q.r": "p"}, flat)
+	}
+}
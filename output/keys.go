@@ -0,0 +1,213 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	defaultEmptyKeyName = "empty_key"
+	// minKeyMaxLength leaves room for a character and the hash suffix of a shortened key.
+	minKeyMaxLength = 10
+)
+
+// keySanitizer rewrites record field names that Logz.io rejects or mangles. It runs after dedot, on the keys
+// of nested objects too.
+type keySanitizer struct {
+	replacer                *strings.Replacer
+	lowercase               bool
+	stripLeadingUnderscores bool
+	emptyName               string
+	// maxLength shortens longer keys and appends a hash of the original key, so shortened keys stay distinct.
+	maxLength int
+}
+
+// loadKeySanitizer reads the key sanitization parameters. It returns nil when no rule is configured.
+func loadKeySanitizer(ctx unsafe.Pointer, logger *Logger) *keySanitizer {
+	sanitizer := &keySanitizer{emptyName: defaultEmptyKeyName}
+	configured := false
+
+	var replacements []string
+	for _, pair := range splitKeyRules(plugin.Environment(ctx, "logzio_key_replace")) {
+		from, to, err := parseKeyReplacement(pair)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Warning: malformed rule '%s' in logzio_key_replace: %v", pair, err))
+			continue
+		}
+		replacements = append(replacements, from, to)
+	}
+	if len(replacements) > 0 {
+		sanitizer.replacer = strings.NewReplacer(replacements...)
+		configured = true
+	}
+
+	sanitizer.lowercase, _ = strconv.ParseBool(plugin.Environment(ctx, "logzio_key_lowercase"))
+	sanitizer.stripLeadingUnderscores, _ = strconv.ParseBool(plugin.Environment(ctx, "logzio_key_strip_leading_underscores"))
+	configured = configured || sanitizer.lowercase || sanitizer.stripLeadingUnderscores
+
+	if emptyName := plugin.Environment(ctx, "logzio_key_empty_name"); emptyName != "" {
+		sanitizer.emptyName = emptyName
+		configured = true
+	}
+
+	if maxLength := plugin.Environment(ctx, "logzio_key_max_length"); maxLength != "" {
+		length, err := strconv.Atoi(maxLength)
+		if err != nil || length < minKeyMaxLength {
+			logger.Warn(fmt.Sprintf("Invalid logzio_key_max_length value '%s'. Must be at least %d. Key length is not limited.", maxLength, minKeyMaxLength))
+		} else {
+			sanitizer.maxLength = length
+			configured = true
+		}
+	}
+
+	if !configured {
+		return nil
+	}
+	return sanitizer
+}
+
+// splitKeyRules splits a comma separated list, keeping commas inside quotes.
+func splitKeyRules(config string) []string {
+	var rules []string
+	start, quoted := 0, false
+	for i := 0; i < len(config); i++ {
+		switch config[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				rules = append(rules, config[start:i])
+				start = i + 1
+			}
+		}
+	}
+	rules = append(rules, config[start:])
+
+	var nonEmpty []string
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) != "" {
+			nonEmpty = append(nonEmpty, strings.TrimSpace(rule))
+		}
+	}
+	return nonEmpty
+}
+
+// parseKeyReplacement parses a "from:to" rule. Both sides may be quoted, e.g. `" ":_` or `":":_`.
+func parseKeyReplacement(rule string) (string, string, error) {
+	from, rest, err := splitKeyRulePart(rule)
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", "", fmt.Errorf("expected format 'from:to'")
+	}
+	to, rest, err := splitKeyRulePart(rest[1:])
+	if err != nil {
+		return "", "", err
+	}
+	if rest != "" {
+		return "", "", fmt.Errorf("unexpected '%s' after the replacement", rest)
+	}
+	if from == "" {
+		return "", "", fmt.Errorf("empty string to replace")
+	}
+	return from, to, nil
+}
+
+// splitKeyRulePart returns the leading quoted string or the text up to the next ':', and the rest of the rule.
+func splitKeyRulePart(rule string) (string, string, error) {
+	rule = strings.TrimSpace(rule)
+	if !strings.HasPrefix(rule, `"`) {
+		if i := strings.IndexByte(rule, ':'); i >= 0 {
+			return strings.TrimSpace(rule[:i]), rule[i:], nil
+		}
+		return rule, "", nil
+	}
+	end := skipQuoted(rule, 0)
+	if end > len(rule) || rule[end-1] != '"' || end == 1 {
+		return "", "", fmt.Errorf("unterminated quoted string")
+	}
+	unquoted, err := strconv.Unquote(rule[:end])
+	if err != nil {
+		return "", "", err
+	}
+	return unquoted, strings.TrimSpace(rule[end:]), nil
+}
+
+// sanitize returns the sanitized key.
+func (sanitizer *keySanitizer) sanitize(key string) string {
+	original := key
+	if sanitizer.replacer != nil {
+		key = sanitizer.replacer.Replace(key)
+	}
+	if sanitizer.lowercase {
+		key = strings.ToLower(key)
+	}
+	if sanitizer.stripLeadingUnderscores {
+		key = strings.TrimLeft(key, "_")
+	}
+	if key == "" {
+		key = sanitizer.emptyName
+	}
+	if sanitizer.maxLength > 0 && len(key) > sanitizer.maxLength {
+		suffix := keyHash(original)
+		key = truncateString(key, sanitizer.maxLength-len(suffix)) + suffix
+	}
+	return key
+}
+
+// placeKey returns the key to store a field under, given its original and sanitized keys. A sanitized key that
+// collides with another field gets the hash suffix of its original key, whichever of the two fields comes first,
+// so the result doesn't depend on the map order. renamed maps the stored sanitized keys to their original keys.
+func (parser *recordParser) placeKey(jsonRecord map[string]interface{}, renamed map[string]string, original string, key string) string {
+	if key != original {
+		parser.sanitizedKeys++
+	}
+	value, exists := jsonRecord[key]
+	if !exists {
+		if key != original {
+			renamed[key] = original
+		}
+		return key
+	}
+
+	// Between two renamed fields, the smaller original key keeps the sanitized key
+	other, isRenamed := renamed[key]
+	if !isRenamed || (key != original && original > other) {
+		return key + keyHash(original)
+	}
+	jsonRecord[key+keyHash(other)] = value
+	delete(jsonRecord, key)
+	delete(renamed, key)
+	if key != original {
+		renamed[key] = original
+	}
+	return key
+}
+
+// sanitizePath sanitizes each key of a dotted path, e.g. the name of a field the plugin adds to records.
+func (sanitizer *keySanitizer) sanitizePath(path string) string {
+	if sanitizer == nil {
+		return path
+	}
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		segments[i] = sanitizer.sanitize(segment)
+	}
+	return strings.Join(segments, ".")
+}
+
+// keyHash returns a short hash suffix of a key, e.g. "_1a2b3c4d".
+func keyHash(key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return fmt.Sprintf("_%08x", hash.Sum32())
+}
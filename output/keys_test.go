@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeySanitizer(config map[string]string) *keySanitizer {
+	plugin = NewTestPluginMock(config, nil)
+	return loadKeySanitizer(nil, NewLogger("testKeys", false))
+}
+
+func TestKeySanitizerConfig(test *testing.T) {
+	require.Nil(test, newTestKeySanitizer(map[string]string{}))
+	require.Nil(test, newTestKeySanitizer(map[string]string{"logzio_key_max_length": "5", "logzio_key_replace": "broken"}))
+
+	sanitizer := newTestKeySanitizer(map[string]string{"logzio_key_replace": `" ":_, @:at_, ":":-, ",":"", "unterminated:x`})
+	require.Equal(test, "a_b_at_c-d", sanitizer.sanitize("a b @c:d"))
+	require.Equal(test, "ab", sanitizer.sanitize("a,b"))
+}
+
+func TestKeySanitize(test *testing.T) {
+	sanitizer := newTestKeySanitizer(map[string]string{
+		"logzio_key_lowercase":                 "true",
+		"logzio_key_strip_leading_underscores": "true",
+		"logzio_key_max_length":                "20",
+	})
+	require.Equal(test, "message", sanitizer.sanitize("__Message"))
+	require.Equal(test, defaultEmptyKeyName, sanitizer.sanitize(""))
+	require.Equal(test, defaultEmptyKeyName, sanitizer.sanitize("___"))
+
+	long := strings.Repeat("k", 30)
+	shortened := sanitizer.sanitize(long)
+	require.Len(test, shortened, 20)
+	require.Equal(test, strings.Repeat("k", 11)+keyHash(long), shortened)
+	require.NotEqual(test, shortened, sanitizer.sanitize(long+"x"))
+}
+
+func TestParseJSONSanitizesKeys(test *testing.T) {
+	parser := &recordParser{
+		dedotEnabled:      true,
+		dedotNested:       true,
+		dedotNewSeparator: "_",
+		keys:              newTestKeySanitizer(map[string]string{"logzio_key_replace": `" ":_,@:`}),
+	}
+	record := map[interface{}]interface{}{
+		"@timestamp": "t",
+		"a b":        1,
+		"a_b":        2,
+		"a.b":        3,
+		"":           "empty",
+		"nested":     []interface{}{map[interface{}]interface{}{"x y": true}},
+	}
+	for i := 0; i < 20; i++ {
+		body := parseJSON(record, parser)
+		require.Equal(test, map[string]interface{}{
+			"timestamp":            "t",
+			"a_b":                  2,
+			"a_b" + keyHash("a b"): 1,
+			"a_b" + keyHash("a.b"): 3,
+			defaultEmptyKeyName:    "empty",
+			"nested":               []interface{}{map[string]interface{}{"x_y": true}},
+		}, body)
+	}
+}
+
+func TestSanitizeKeysOfAddedFields(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":         testToken,
+		"id":                   testId,
+		"logzio_key_replace":   `" ":_,@:at_`,
+		"logzio_key_lowercase": "true",
+		"logzio_add_fields":    "Team Name:core",
+		"logzio_logfmt_field":  "message",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+
+	record := map[interface{}]interface{}{"message": "request done UserId=5 @Path=/login", "Host Name": "web-1"}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "core", result["team_name"])
+	require.Equal(test, float64(5), result["userid"])
+	require.Equal(test, "/login", result["at_path"])
+	require.Equal(test, "web-1", result["host_name"])
+	require.NotContains(test, result, "Team Name")
+	require.NotContains(test, result, "UserId")
+	// Fields of the plugin keep their names
+	require.Contains(test, result, "@timestamp")
+	require.Equal(test, "tag", result["fluentbit_tag"])
+	require.Equal(test, uint64(3), instance.counters.Get("keys.sanitized"))
+}
+
+func TestSanitizeKeysOnce(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":         testToken,
+		"id":                   testId,
+		"logzio_key_replace":   "a:aa",
+		"logzio_add_fields":    "da:added",
+		"logzio_rename_fields": "x:ra",
+		"logzio_logfmt_field":  "log",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+
+	record := map[interface{}]interface{}{"a": "record", "x": "renamed", "log": "ca=1"}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "record", result["aa"])
+	require.Equal(test, "added", result["daa"])
+	require.Equal(test, "renamed", result["raa"])
+	require.Equal(test, float64(1), result["caa"])
+	for _, twice := range []string{"aaaa", "daaaa", "raaaa", "caaaa"} {
+		require.NotContains(test, result, twice)
+	}
+}
@@ -0,0 +1,228 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// truncatedKey lists the dotted paths of the fields a limit truncated, stringified or removed.
+	truncatedKey = "_truncated"
+	// maxTruncatedPaths caps the paths listed under truncatedKey, so the marker can't grow the record much.
+	maxTruncatedPaths = 20
+)
+
+// recordLimits bounds the size and shape of a record. A zero limit is disabled.
+type recordLimits struct {
+	maxFieldLength int
+	maxRecordBytes int
+	maxDepth       int
+	maxFields      int
+	// protected fields are always written by the plugin and are never truncated, removed or counted.
+	protected map[string]bool
+}
+
+// loadRecordLimits reads the record limit parameters. It returns nil when all limits are disabled.
+func loadRecordLimits(ctx unsafe.Pointer, logger *Logger, protected ...string) *recordLimits {
+	limits := &recordLimits{
+		maxFieldLength: loadLimit(ctx, "logzio_max_field_length", logger),
+		maxRecordBytes: loadLimit(ctx, "logzio_max_record_bytes", logger),
+		maxDepth:       loadLimit(ctx, "logzio_max_depth", logger),
+		maxFields:      loadLimit(ctx, "logzio_max_fields", logger),
+		protected:      map[string]bool{truncatedKey: true},
+	}
+	if limits.maxFieldLength == 0 && limits.maxRecordBytes == 0 && limits.maxDepth == 0 && limits.maxFields == 0 {
+		return nil
+	}
+	for _, key := range protected {
+		if key != "" {
+			limits.protected[key] = true
+		}
+	}
+	return limits
+}
+
+func loadLimit(ctx unsafe.Pointer, key string, logger *Logger) int {
+	value := plugin.Environment(ctx, key)
+	if value == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		logger.Warn(fmt.Sprintf("Invalid %s value '%s'. The limit is disabled.", key, value))
+		return 0
+	}
+	return limit
+}
+
+// truncation collects the paths of the fields changed by the limits.
+type truncation struct {
+	paths  []string
+	fields int
+}
+
+func (truncation *truncation) add(path string) {
+	truncation.fields++
+	if len(truncation.paths) < maxTruncatedPaths {
+		truncation.paths = append(truncation.paths, path)
+	}
+}
+
+// addOnce adds a path that isn't listed yet, so shrinking a field again doesn't count it twice.
+func (truncation *truncation) addOnce(path string) {
+	for _, listed := range truncation.paths {
+		if listed == path {
+			return
+		}
+	}
+	truncation.add(path)
+}
+
+// markerSize returns the bytes the paths take in a serialized record, with their key and separator.
+func markerSize(paths []string) int {
+	if len(paths) == 0 {
+		return 0
+	}
+	serialized, err := jsoniter.Marshal(paths)
+	if err != nil {
+		return 0
+	}
+	// The quotes of the key, the colon and the comma
+	return len(truncatedKey) + len(serialized) + 4
+}
+
+// apply enforces the field length, depth and field count limits on the record body. Fields are visited
+// in key order, so the fields above the count limit are always the same ones.
+func (limits *recordLimits) apply(body map[string]interface{}) *truncation {
+	truncation := &truncation{}
+	count := 0
+	limits.limitMap(body, "", 1, &count, truncation)
+	return truncation
+}
+
+func (limits *recordLimits) limitMap(nested map[string]interface{}, prefix string, depth int, count *int, truncation *truncation) {
+	keys := make([]string, 0, len(nested))
+	for key := range nested {
+		if depth > 1 || !limits.protected[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := prefix + key
+		if limits.maxFields > 0 && *count >= limits.maxFields {
+			delete(nested, key)
+			truncation.add(path)
+			continue
+		}
+		*count++
+		nested[key] = limits.limitValue(nested[key], path, depth, count, truncation)
+	}
+}
+
+func (limits *recordLimits) limitValue(value interface{}, path string, depth int, count *int, truncation *truncation) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		if limits.maxDepth > 0 && depth >= limits.maxDepth {
+			serialized, err := jsoniter.MarshalToString(v)
+			if err != nil {
+				serialized = fmt.Sprint(v)
+			}
+			truncation.add(path)
+			return limits.limitString(serialized, path, nil)
+		}
+		if nested, isMap := v.(map[string]interface{}); isMap {
+			limits.limitMap(nested, path+".", depth+1, count, truncation)
+			return nested
+		}
+		array := v.([]interface{})
+		for i, element := range array {
+			array[i] = limits.limitValue(element, path, depth+1, count, truncation)
+		}
+		return array
+	case string:
+		return limits.limitString(v, path, truncation)
+	default:
+		return value
+	}
+}
+
+// limitString truncates text to the field length limit, at a character boundary.
+func (limits *recordLimits) limitString(text string, path string, truncation *truncation) string {
+	if limits.maxFieldLength == 0 || len(text) <= limits.maxFieldLength {
+		return text
+	}
+	if truncation != nil {
+		truncation.add(path)
+	}
+	return truncateString(text, limits.maxFieldLength)
+}
+
+// truncateString cuts text to at most size bytes without splitting a character.
+func truncateString(text string, size int) string {
+	if size <= 0 {
+		return ""
+	}
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size]
+}
+
+// fit shrinks a serialized record above the record size limit, starting from its largest field:
+// a string is truncated by the excess size, including the growth of the truncated fields marker, and any
+// other value is removed. written are the fields the plugin added to this record, which are kept like the
+// protected ones. It returns an error when the record is still too large with only those fields left.
+func (limits *recordLimits) fit(body map[string]interface{}, serialized []byte, truncation *truncation, written ...string) ([]byte, error) {
+	kept := make(map[string]bool, len(written))
+	for _, key := range written {
+		kept[key] = true
+	}
+	for len(serialized) > limits.maxRecordBytes {
+		largestKey, largestSize := "", 0
+		for key, value := range body {
+			if limits.protected[key] || kept[key] {
+				continue
+			}
+			fieldBytes, err := jsoniter.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			if size := len(key) + len(fieldBytes); size > largestSize || (size == largestSize && key < largestKey) {
+				largestKey, largestSize = key, size
+			}
+		}
+		if largestKey == "" {
+			return nil, fmt.Errorf("record of %d bytes is larger than logzio_max_record_bytes (%d) without its removable fields",
+				len(serialized), limits.maxRecordBytes)
+		}
+
+		previousMarker := markerSize(truncation.paths)
+		truncation.addOnce(largestKey)
+		excess := len(serialized) - limits.maxRecordBytes + markerSize(truncation.paths) - previousMarker
+		if text, isText := body[largestKey].(string); isText && len(text) > excess {
+			body[largestKey] = truncateString(text, len(text)-excess)
+		} else {
+			delete(body, largestKey)
+		}
+		body[truncatedKey] = truncation.paths
+
+		var err error
+		if serialized, err = jsoniter.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	return serialized, nil
+}
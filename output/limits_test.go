@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRecordLimits(config map[string]string) *recordLimits {
+	plugin = NewTestPluginMock(config, nil)
+	return loadRecordLimits(nil, NewLogger("testLimits", false), "type")
+}
+
+func TestRecordLimitsConfig(test *testing.T) {
+	require.Nil(test, newTestRecordLimits(map[string]string{}))
+	require.Nil(test, newTestRecordLimits(map[string]string{"logzio_max_depth": "-1", "logzio_max_fields": "many"}))
+
+	limits := newTestRecordLimits(map[string]string{"logzio_max_field_length": "10", "logzio_max_record_bytes": "1000"})
+	require.Equal(test, 10, limits.maxFieldLength)
+	require.Equal(test, 1000, limits.maxRecordBytes)
+	require.True(test, limits.protected["type"])
+}
+
+func TestRecordLimitsApply(test *testing.T) {
+	limits := newTestRecordLimits(map[string]string{
+		"logzio_max_field_length": "8",
+		"logzio_max_depth":        "2",
+		"logzio_max_fields":       "5",
+	})
+	body := map[string]interface{}{
+		"a_message": "héllo world",
+		"b_nested": map[string]interface{}{
+			"deep":  map[string]interface{}{"x": 1},
+			"short": "ok",
+		},
+		"c_list": []interface{}{"0123456789", map[string]interface{}{"y": 2}},
+		"d_over": "removed",
+		"type":   "protected type value",
+	}
+	truncation := limits.apply(body)
+	require.Equal(test, map[string]interface{}{
+		"a_message": "héllo w",
+		"b_nested":  map[string]interface{}{"deep": `{"x":1}`, "short": "ok"},
+		"c_list":    []interface{}{"01234567", `{"y":2}`},
+		"type":      "protected type value",
+	}, body)
+	require.Equal(test, []string{"a_message", "b_nested.deep", "c_list", "c_list", "d_over"}, truncation.paths)
+	require.Equal(test, 5, truncation.fields)
+}
+
+func TestRecordLimitsFit(test *testing.T) {
+	instance := &LogzioOutput{
+		logger:   NewLogger("testLimits", false),
+		ltype:    "type1",
+		id:       "out1",
+		counters: NewCounters(),
+		limits:   newTestRecordLimits(map[string]string{"logzio_max_record_bytes": "400"}),
+	}
+	instance.limits.protected["host"] = true
+	instance.limits.protected["fluentbit_tag"] = true
+	instance.limits.protected["output_id"] = true
+	instance.limits.protected["@timestamp"] = true
+
+	record := map[interface{}]interface{}{
+		"message": strings.Repeat("m", 300),
+		"payload": map[interface{}]interface{}{"data": strings.Repeat("p", 300)},
+		"small":   "kept",
+	}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	require.LessOrEqual(test, len(serialized), 400)
+
+	body := make(map[string]interface{})
+	require.NoError(test, json.Unmarshal(serialized, &body))
+	require.NotContains(test, body, "payload")
+	require.Equal(test, "kept", body["small"])
+	require.True(test, strings.HasPrefix(body["message"].(string), "mmm"))
+	require.ElementsMatch(test, []interface{}{"payload", "message"}, body[truncatedKey])
+	require.Equal(test, uint64(1), instance.counters.Get("records.truncated"))
+
+	instance.limits.maxRecordBytes = 10
+	_, err = serializeRecord(time.Now(), "tag", record, instance)
+	require.Error(test, err)
+	require.Equal(test, uint64(1), instance.counters.Get("records.oversized_dropped"))
+}
+
+func TestTruncateString(test *testing.T) {
+	require.Equal(test, "ab", truncateString("abc", 2))
+	require.Equal(test, "a", truncateString("aé", 2))
+	require.Equal(test, "", truncateString("abc", 0))
+	require.Equal(test, "abc", truncateString("abc", 5))
+}
+
+func TestRecordLimitsFitConverges(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{"logzio_max_record_bytes": "300"}, nil)
+	instance := &LogzioOutput{
+		logger:          NewLogger("testLimits", false),
+		ltype:           "type1",
+		id:              "out1",
+		counters:        NewCounters(),
+		timestampWriter: &timestampWriter{key: defaultTimestampKey},
+		limits:          loadRecordLimits(nil, NewLogger("testLimits", false), "fluentbit_tag", "output_id", defaultTimestampKey),
+	}
+	record := map[interface{}]interface{}{"message": strings.Repeat("m", 400)}
+	serialized, destination, err := serializeRoutedRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	require.NotNil(test, destination)
+	require.LessOrEqual(test, len(serialized), 300)
+
+	body := make(map[string]interface{})
+	require.NoError(test, json.Unmarshal(serialized, &body))
+	require.True(test, strings.HasPrefix(body["message"].(string), "mmm"))
+	require.Equal(test, []interface{}{"message"}, body[truncatedKey])
+	require.Equal(test, uint64(1), instance.counters.Get("fields.truncated"))
+	require.Equal(test, uint64(0), instance.counters.Get("records.oversized_dropped"))
+}
+
+func TestRecordLimitsOwnTypeAndHost(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{"logzio_max_field_length": "10"}, nil)
+	instance := &LogzioOutput{
+		logger:          NewLogger("testLimits", false),
+		ltype:           strings.Repeat("t", 20),
+		id:              "out1",
+		counters:        NewCounters(),
+		timestampWriter: &timestampWriter{key: defaultTimestampKey},
+		limits:          loadRecordLimits(nil, NewLogger("testLimits", false), "fluentbit_tag", "output_id", defaultTimestampKey),
+	}
+	record := map[interface{}]interface{}{"type": strings.Repeat("a", 50), "host": strings.Repeat("h", 50)}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	body := make(map[string]interface{})
+	require.NoError(test, json.Unmarshal(serialized, &body))
+	require.Equal(test, strings.Repeat("a", 10), body["type"])
+	require.Equal(test, strings.Repeat("h", 10), body["host"])
+
+	// The type the plugin writes is kept
+	serialized, err = serializeRecord(time.Now(), "tag", map[interface{}]interface{}{"message": "ok"}, instance)
+	require.NoError(test, err)
+	require.NoError(test, json.Unmarshal(serialized, &body))
+	require.Equal(test, strings.Repeat("t", 20), body["type"])
+}
@@ -0,0 +1,210 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// msgpackKind is the type of a msgpack value.
+type msgpackKind int
+
+const (
+	msgpackNil msgpackKind = iota
+	msgpackBool
+	msgpackInt
+	msgpackUint
+	msgpackFloat
+	msgpackString
+	msgpackBinary
+	msgpackArray
+	msgpackMap
+	msgpackExt
+)
+
+var errMsgpackTruncated = errors.New("truncated msgpack data")
+
+// msgpackToken is the header of a msgpack value. The bytes of strings, binaries and extensions point into the
+// read data. Arrays and maps only hold their length, and their elements are the next tokens.
+type msgpackToken struct {
+	kind    msgpackKind
+	boolean bool
+	int     int64
+	uint    uint64
+	float   float64
+	bytes   []byte
+	length  int
+	extType int8
+}
+
+// msgpackReader reads msgpack values from a byte slice without copying them.
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (reader *msgpackReader) done() bool {
+	return reader.pos >= len(reader.data)
+}
+
+// next reads the next token. Integers of the unsigned formats are read as uint, like the codec package does.
+func (reader *msgpackReader) next() (token msgpackToken, err error) {
+	if reader.done() {
+		return token, errMsgpackTruncated
+	}
+	b := reader.data[reader.pos]
+	reader.pos++
+
+	switch {
+	case b <= 0x7f:
+		token.kind, token.int = msgpackInt, int64(b)
+		return token, nil
+	case b >= 0xe0:
+		token.kind, token.int = msgpackInt, int64(int8(b))
+		return token, nil
+	case b <= 0x8f:
+		token.kind, token.length = msgpackMap, int(b&0x0f)
+		return token, nil
+	case b <= 0x9f:
+		token.kind, token.length = msgpackArray, int(b&0x0f)
+		return token, nil
+	case b <= 0xbf:
+		token.kind = msgpackString
+		token.bytes, err = reader.read(int(b & 0x1f))
+		return token, err
+	}
+
+	switch b {
+	case 0xc0:
+		token.kind = msgpackNil
+	case 0xc2, 0xc3:
+		token.kind, token.boolean = msgpackBool, b == 0xc3
+	case 0xc4, 0xc5, 0xc6:
+		token.kind = msgpackBinary
+		token.bytes, err = reader.readSized(1 << (b - 0xc4))
+	case 0xc7, 0xc8, 0xc9:
+		var length uint64
+		if length, err = reader.uint(1 << (b - 0xc7)); err == nil {
+			token, err = reader.ext(int(length))
+		}
+	case 0xca:
+		var bits uint64
+		bits, err = reader.uint(4)
+		token.kind, token.float = msgpackFloat, float64(math.Float32frombits(uint32(bits)))
+	case 0xcb:
+		var bits uint64
+		bits, err = reader.uint(8)
+		token.kind, token.float = msgpackFloat, math.Float64frombits(bits)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		token.kind = msgpackUint
+		token.uint, err = reader.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		var value uint64
+		value, err = reader.uint(1 << (b - 0xd0))
+		token.kind = msgpackInt
+		switch b {
+		case 0xd0:
+			token.int = int64(int8(value))
+		case 0xd1:
+			token.int = int64(int16(value))
+		case 0xd2:
+			token.int = int64(int32(value))
+		default:
+			token.int = int64(value)
+		}
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		token, err = reader.ext(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		token.kind = msgpackString
+		token.bytes, err = reader.readSized(1 << (b - 0xd9))
+	case 0xdc, 0xdd:
+		var length uint64
+		length, err = reader.uint(2 << (b - 0xdc))
+		token.kind, token.length = msgpackArray, int(length)
+	case 0xde, 0xdf:
+		var length uint64
+		length, err = reader.uint(2 << (b - 0xde))
+		token.kind, token.length = msgpackMap, int(length)
+	default:
+		err = fmt.Errorf("invalid msgpack format 0x%x", b)
+	}
+	return token, err
+}
+
+// skip reads past the next value, including the elements of arrays and maps.
+func (reader *msgpackReader) skip() error {
+	for pending := 1; pending > 0; pending-- {
+		token, err := reader.next()
+		if err != nil {
+			return err
+		}
+		switch token.kind {
+		case msgpackArray:
+			pending += token.length
+		case msgpackMap:
+			pending += 2 * token.length
+		}
+	}
+	return nil
+}
+
+// uint reads a big endian unsigned integer of size bytes.
+func (reader *msgpackReader) uint(size int) (uint64, error) {
+	if len(reader.data)-reader.pos < size {
+		return 0, errMsgpackTruncated
+	}
+	var value uint64
+	for _, b := range reader.data[reader.pos : reader.pos+size] {
+		value = value<<8 | uint64(b)
+	}
+	reader.pos += size
+	return value, nil
+}
+
+// read returns the next length bytes.
+func (reader *msgpackReader) read(length int) ([]byte, error) {
+	if length < 0 || len(reader.data)-reader.pos < length {
+		return nil, errMsgpackTruncated
+	}
+	bytes := reader.data[reader.pos : reader.pos+length]
+	reader.pos += length
+	return bytes, nil
+}
+
+// readSized returns the bytes following their length, a big endian integer of size bytes.
+func (reader *msgpackReader) readSized(size int) ([]byte, error) {
+	length, err := reader.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	return reader.read(int(length))
+}
+
+// ext reads the type and the data of an extension of length bytes.
+func (reader *msgpackReader) ext(length int) (msgpackToken, error) {
+	token := msgpackToken{kind: msgpackExt}
+	extType, err := reader.uint(1)
+	if err != nil {
+		return token, err
+	}
+	token.extType = int8(extType)
+	token.bytes, err = reader.read(length)
+	return token, err
+}
+
+// isMsgpackMap reports whether the encoded value is a map.
+func isMsgpackMap(data []byte) bool {
+	return len(data) > 0 && (data[0]&0xf0 == 0x80 || data[0] == 0xde || data[0] == 0xdf)
+}
+
+// bytesString returns the bytes as a string without copying them. The bytes must not change while the string is used.
+func bytesString(bytes []byte) string {
+	if len(bytes) == 0 {
+		return ""
+	}
+	return unsafe.String(&bytes[0], len(bytes))
+}
@@ -5,47 +5,78 @@ package main
 
 import (
 	"C"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"github.com/fluent/fluent-bit-go/output"
 	jsoniter "github.com/json-iterator/go"
 	"os"
+	"path/filepath"
 	"reflect"
-	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
 const (
-	outputDescription = "This is a fluent-bit output plugin that sends data to Logz.io"
-	outputName        = "logzio"
-	defaultLogType    = "logzio-fluent-bit"
+	outputDescription      = "This is a fluent-bit output plugin that sends data to Logz.io"
+	outputName             = "logzio"
+	defaultLogType         = "logzio-fluent-bit"
+	defaultShutdownTimeout = 5 * time.Second
 )
 
 var (
 	outputs map[string]*LogzioOutput
-	plugin  Plugin = &bitPlugin{}
+	// outputsMu guards outputs, since init, flush and exit callbacks may run on different threads
+	outputsMu sync.RWMutex
+	plugin    Plugin = &bitPlugin{}
 )
 
 type LogzioOutput struct {
-	logger            *Logger
-	client            *LogzioClient
-	ltype             string
-	id                string
-	dedotEnabled      bool
-	dedotNested       bool
-	dedotNewSeparator string
-	headers           map[string]string
+	logger             *Logger
+	client             *LogzioClient
+	ltype              string
+	id                 string
+	dedotEnabled       bool
+	dedotNested        bool
+	dedotNewSeparator  string
+	headers            map[string]string
+	shutdownTimeout    time.Duration
+	mainRoute          *route
+	tagRoutes          []*tagRoute
+	fieldRules         []*fieldRule
+	counters           *Counters
+	addedFields        []addedField
+	addFieldsOverwrite bool
+	fieldFilter        *fieldFilter
+	fieldRenamer       *fieldRenamer
+	redactor           *redactor
+	flattener          *flattener
+	fieldExpander      *fieldExpander
+	logfmtParser       *logfmtParser
+	levelNormalizer    *levelNormalizer
+	timeParser         *timeParser
+	timestampWriter    *timestampWriter
+	metadataKey        string
+	groupKey           string
+	utf8Policy         *utf8Policy
+	limits             *recordLimits
+	schema             *fieldSchema
+	keySanitizer       *keySanitizer
 }
 
 // Plugin interface
 type Plugin interface {
 	Environment(ctx unsafe.Pointer, key string) string
 	Unregister(ctx unsafe.Pointer)
-	GetRecord(dec *output.FLBDecoder) (ret int, ts interface{}, rec map[interface{}]interface{})
-	NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder
+	GetRecord(dec *eventDecoder) (ret int, event logEvent)
+	NewDecoder(data unsafe.Pointer, length int) *eventDecoder
 	Send(values []byte, client *LogzioClient) int
 	Flush(*LogzioClient) int
 }
@@ -60,12 +91,19 @@ func (p *bitPlugin) Unregister(ctx unsafe.Pointer) {
 	output.FLBPluginUnregister(ctx)
 }
 
-func (p *bitPlugin) GetRecord(dec *output.FLBDecoder) (ret int, ts interface{}, rec map[interface{}]interface{}) {
-	return output.GetRecord(dec)
+func (p *bitPlugin) GetRecord(dec *eventDecoder) (ret int, event logEvent) {
+	event, err := dec.next()
+	if err == io.EOF {
+		return eventEnd, event
+	}
+	if err != nil {
+		return eventMalformed, event
+	}
+	return eventOK, event
 }
 
-func (p *bitPlugin) NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder {
-	return output.NewDecoder(data, length)
+func (p *bitPlugin) NewDecoder(data unsafe.Pointer, length int) *eventDecoder {
+	return newEventDecoder(C.GoBytes(data, C.int(length)))
 }
 
 func (p *bitPlugin) Send(log []byte, client *LogzioClient) int {
@@ -122,25 +160,22 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 // When done, there are three returning values available: FLB_OK, FLB_ERROR, FLB_RETRY.
 //
 //export FLBPluginFlushCtx
-func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	var id string
-	var outputInstance *LogzioOutput
-	var ok bool
+func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) (result int) {
+	// A panic must not unwind into Fluent Bit, which would crash the whole agent
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[%s] Error: recovered from panic in flush: %v\n%s", outputName, r, debug.Stack())
+			result = output.FLB_ERROR
+		}
+	}()
 
-	// Get ID from context
-	ctxID := output.FLBPluginGetContext(ctx)
-	if ctxID == nil {
-		log.Printf("[%s] Error: Flush context is nil.", outputName)
-		return output.FLB_ERROR
-	}
-	id, ok = ctxID.(string)
-	if !ok || id == "" {
-		log.Printf("[%s] Error: Invalid context ID (%v).", outputName, ctxID)
+	id, ok := contextID(ctx)
+	if !ok {
 		return output.FLB_ERROR
 	}
 
 	// Retrieve instance config
-	outputInstance, ok = outputs[id]
+	outputInstance, ok := getOutput(id)
 	if !ok {
 		log.Printf("[%s] Error: Config missing for output ID '%s'.", outputName, id)
 		return output.FLB_ERROR
@@ -148,51 +183,198 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	instanceLogger := outputInstance.logger
 
 	dec := plugin.NewDecoder(data, int(length))
+	goTag := C.GoString(tag)
+	var transcoder *recordTranscoder
+	if dec != nil && outputInstance.transcodable() {
+		dec.lazy = true
+		transcoder = outputInstance.newRecordTranscoder()
+	}
 
 	lastErrCode := output.FLB_OK
+	var usedRoutes []*route
 	for {
-		ret, ts, record := plugin.GetRecord(dec)
-		if ret != 0 {
+		ret, event := plugin.GetRecord(dec)
+		if ret == eventMalformed {
+			outputInstance.counters.Add("events.malformed", 1)
+			continue
+		}
+		if ret != eventOK {
 			break
 		}
-
-		// Pass instance to serializeRecord
-		logBytes, err := serializeRecord(ts, C.GoString(tag), record, outputInstance)
+		logBytes, destination, err := outputInstance.serializeEvent(dec, transcoder, event, goTag)
 		if err != nil {
+			outputInstance.counters.Add("records.serialize_failed", 1)
 			instanceLogger.Log(fmt.Sprintf("Error serializing record: %v. Skipping.", err))
 			continue
 		}
+		usedRoutes = appendRoute(usedRoutes, destination)
 
-		res := plugin.Send(logBytes, outputInstance.client)
+		res := plugin.Send(logBytes, destination.client)
 		if res != output.FLB_OK {
-			instanceLogger.Log(fmt.Sprintf("Send returned error code %d.", res))
+			instanceLogger.Log(fmt.Sprintf("Send returned error code %d for route '%s'.", res, destination.name))
 			lastErrCode = res
 		}
 	}
 
 	// Final Flush
-	flushResult := plugin.Flush(outputInstance.client)
-	if flushResult != output.FLB_OK {
-		instanceLogger.Log(fmt.Sprintf("Final Flush returned error code %d.", flushResult))
-		if lastErrCode == output.FLB_OK || flushResult == output.FLB_ERROR {
-			lastErrCode = flushResult
+	for _, usedRoute := range usedRoutes {
+		flushResult := plugin.Flush(usedRoute.client)
+		if flushResult != output.FLB_OK {
+			instanceLogger.Log(fmt.Sprintf("Final Flush returned error code %d for route '%s'.", flushResult, usedRoute.name))
+			if lastErrCode == output.FLB_OK || flushResult == output.FLB_ERROR {
+				lastErrCode = flushResult
+			}
 		}
 	}
 
 	return lastErrCode
 }
 
+func appendRoute(routes []*route, candidate *route) []*route {
+	for _, existing := range routes {
+		if existing.client == candidate.client {
+			return routes
+		}
+	}
+	return append(routes, candidate)
+}
+
+// FLBPluginExitCtx When Fluent Bit stops a single instance of the plugin, e.g. on a config reload,
+// it will trigger the per-instance exit callback.
+//
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	id, ok := contextID(ctx)
+	if !ok {
+		return output.FLB_ERROR
+	}
+	return exitOutput(id)
+}
+
+// exitOutput drains the output instance and removes it from the outputs map.
+func exitOutput(id string) int {
+	outputInstance, ok := removeOutput(id)
+	if !ok {
+		log.Printf("[%s] Error: Config missing for output ID '%s'.", outputName, id)
+		return output.FLB_ERROR
+	}
+	return outputInstance.shutdown()
+}
+
+func getOutput(id string) (*LogzioOutput, bool) {
+	outputsMu.RLock()
+	defer outputsMu.RUnlock()
+	instance, ok := outputs[id]
+	return instance, ok
+}
+
+func removeOutput(id string) (*LogzioOutput, bool) {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	instance, ok := outputs[id]
+	delete(outputs, id)
+	return instance, ok
+}
+
+// registerOutput adds the output instance to the outputs map. When an instance with the same id
+// already exists, e.g. after a config reload, its pending records are handed over and it is closed.
+func registerOutput(instance *LogzioOutput) {
+	outputsMu.Lock()
+	if outputs == nil {
+		outputs = make(map[string]*LogzioOutput)
+	}
+	previous, exists := outputs[instance.id]
+	outputs[instance.id] = instance
+	outputsMu.Unlock()
+
+	if exists && previous != instance {
+		instance.logger.Warn(fmt.Sprintf("Output instance with id '%s' already configured. Replacing it.", instance.id))
+		for _, previousRoute := range previous.routes() {
+			previousRoute.client.HandOver(instance.routeByName(previousRoute.name).client)
+		}
+	}
+}
+
+// contextID returns the output ID stored in the plugin context on init.
+func contextID(ctx unsafe.Pointer) (string, bool) {
+	ctxID := output.FLBPluginGetContext(ctx)
+	if ctxID == nil {
+		log.Printf("[%s] Error: Plugin context is nil.", outputName)
+		return "", false
+	}
+	id, ok := ctxID.(string)
+	if !ok || id == "" {
+		log.Printf("[%s] Error: Invalid context ID (%v).", outputName, ctxID)
+		return "", false
+	}
+	return id, true
+}
+
 // FLBPluginExit When Fluent Bit will stop using the instance of the plugin,
 // it will trigger the exit callback.
 //
 //export FLBPluginExit
 func FLBPluginExit() int {
+	outputsMu.RLock()
+	exporters := make([]*LogzioOutput, 0, len(outputs))
 	for _, exporter := range outputs {
-		plugin.Flush(exporter.client)
+		exporters = append(exporters, exporter)
+	}
+	outputsMu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, exporter := range exporters {
+		wg.Add(1)
+		go func(exporter *LogzioOutput) {
+			defer wg.Done()
+			exporter.shutdown()
+		}(exporter)
 	}
+	wg.Wait()
 	return output.FLB_OK
 }
 
+// shutdown drains the output client until the shutdown timeout and logs what happened to its records.
+func (instance *LogzioOutput) shutdown() int {
+	timeout := instance.shutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	routes := instance.routes()
+	results := make([]int, len(routes))
+	var wg sync.WaitGroup
+	for i, outputRoute := range routes {
+		wg.Add(1)
+		go func(i int, client *LogzioClient) {
+			defer wg.Done()
+			results[i] = client.Shutdown(ctx)
+		}(i, outputRoute.client)
+	}
+	wg.Wait()
+
+	res := output.FLB_OK
+	for i, outputRoute := range routes {
+		if results[i] != output.FLB_OK {
+			instance.logger.Log(fmt.Sprintf("Shutdown drain returned error code %d for route '%s'.", results[i], outputRoute.name))
+			res = results[i]
+		}
+		counters := outputRoute.client.counters
+		instance.logger.Log(fmt.Sprintf("Shutdown summary for route '%s': routed %d, sent %d, rejected %d, failed %d, persisted %d, dropped %d records.",
+			outputRoute.name, instance.counters.Get("route."+outputRoute.name+".records"), counters.Get("records.sent"), counters.Get("records.rejected"),
+			counters.Get("records.failed"), counters.Get("records.persisted"), counters.Get("records.dropped")))
+		if summary := counters.String(); summary != "" {
+			instance.logger.Log(fmt.Sprintf("Client counters for route '%s': %s.", outputRoute.name, summary))
+		}
+	}
+	if summary := instance.counters.String(); summary != "" {
+		instance.logger.Log(fmt.Sprintf("Output counters: %s.", summary))
+	}
+	return res
+}
+
 func initConfigParams(ctx unsafe.Pointer) error {
 	outputId := plugin.Environment(ctx, "id")
 	if outputId == "" {
@@ -204,14 +386,6 @@ func initConfigParams(ctx unsafe.Pointer) error {
 	debug, _ := strconv.ParseBool(debugStr) 
 	instanceLogger := NewLogger(fmt.Sprintf("%s_%s", outputName, outputId), debug)
 
-	if outputs == nil {
-		outputs = make(map[string]*LogzioOutput)
-	}
-	// Check for duplicate ID warning
-	if _, exists := outputs[outputId]; exists {
-		instanceLogger.Warn(fmt.Sprintf("Output instance with id '%s' already configured. Overwriting.", outputId))
-	}
-
 	// Read other parameters
 	ltype := plugin.Environment(ctx, "logzio_type")
 	if ltype == "" {
@@ -276,6 +450,84 @@ func initConfigParams(ctx unsafe.Pointer) error {
 		}
 	}
 
+	// Field Filter Config
+	fieldFilter := newFieldFilter(plugin.Environment(ctx, "logzio_include_fields"), plugin.Environment(ctx, "logzio_exclude_fields"))
+
+	// Key Sanitization Config
+	keySanitizer := loadKeySanitizer(ctx, instanceLogger)
+
+	// Invalid UTF-8 Config
+	utf8Policy := loadUTF8Policy(ctx, instanceLogger)
+
+	// Field Parsing Config
+	fieldExpander := loadFieldExpander(ctx, instanceLogger)
+	logfmtParser := loadLogfmtParser(ctx, instanceLogger)
+
+	// Level Normalization Config
+	levelNormalizer := loadLevelNormalizer(ctx, instanceLogger)
+
+	// Rename Config
+	fieldRenamer := newFieldRenamer(plugin.Environment(ctx, "logzio_rename_fields"), plugin.Environment(ctx, "logzio_rename_conflict"), instanceLogger)
+
+	// Redaction Config
+	redactor, err := loadRedactor(ctx, instanceLogger)
+	if err != nil {
+		return err
+	}
+
+	// Record Time Config
+	timeParser, err := loadTimeParser(ctx, instanceLogger)
+	if err != nil {
+		return err
+	}
+
+	// Timestamp Output Config
+	timestampWriter := newTimestampWriter(ctx, instanceLogger)
+
+	// Schema Config
+	schema, err := loadFieldSchema(ctx, instanceLogger)
+	if err != nil {
+		return err
+	}
+
+	// Record Limits Config
+	limits := loadRecordLimits(ctx, instanceLogger, "fluentbit_tag", "output_id",
+		timestampWriter.key, timestampWriter.nanosKey)
+
+	// Flatten Config
+	var flattener *flattener
+	if flattenEnabled, _ := strconv.ParseBool(plugin.Environment(ctx, "logzio_flatten_enabled")); flattenEnabled {
+		flattenMaxDepthStr := plugin.Environment(ctx, "logzio_flatten_max_depth")
+		flattenMaxDepth := 0
+		if flattenMaxDepthStr != "" {
+			flattenMaxDepth, err = strconv.Atoi(flattenMaxDepthStr)
+			if err != nil {
+				instanceLogger.Warn(fmt.Sprintf("Failed to parse logzio_flatten_max_depth ('%s'): %v. Flattening all levels.", flattenMaxDepthStr, err))
+				flattenMaxDepth = 0
+			}
+		}
+		flattener = newFlattener(plugin.Environment(ctx, "logzio_flatten_separator"), flattenMaxDepth,
+			plugin.Environment(ctx, "logzio_flatten_arrays"), instanceLogger)
+	}
+
+	// Added Fields Config
+	addedFields := parseAddedFields(plugin.Environment(ctx, "logzio_add_fields"), instanceLogger)
+	addFieldsOverwrite, _ := strconv.ParseBool(plugin.Environment(ctx, "logzio_add_fields_overwrite"))
+
+	// The fields added to records are named like the sanitized record keys. Parsed fields are sanitized
+	// with the record, and the configured names once here, so a rule is never applied twice.
+	for i := range addedFields {
+		addedFields[i].path = keySanitizer.sanitizePath(addedFields[i].path)
+	}
+	if fieldRenamer != nil {
+		for i := range fieldRenamer.rules {
+			fieldRenamer.rules[i].destination = keySanitizer.sanitizePath(fieldRenamer.rules[i].destination)
+		}
+	}
+	if levelNormalizer != nil {
+		levelNormalizer.target = keySanitizer.sanitizePath(levelNormalizer.target)
+	}
+
 	// Bulk Size Config
 	bulkSizeMBStr := plugin.Environment(ctx, "logzio_bulk_size_mb")
 	var bulkSizeOption ClientOptionFunc
@@ -290,48 +542,184 @@ func initConfigParams(ctx unsafe.Pointer) error {
 	    instanceLogger.Debug("logzio_bulk_size_mb not set. Using client default.")
 	}
 
+	// Interval flush and bulk records Config
+	var flushInterval time.Duration
+	flushIntervalStr := plugin.Environment(ctx, "logzio_flush_interval")
+	if flushIntervalStr != "" {
+		flushInterval, err = time.ParseDuration(flushIntervalStr)
+		if err != nil || flushInterval < 0 {
+			instanceLogger.Warn(fmt.Sprintf("Failed to parse logzio_flush_interval ('%s'). Interval flush is disabled.", flushIntervalStr))
+			flushInterval = 0
+		}
+	}
+	var maxBulkRecords int
+	maxBulkRecordsStr := plugin.Environment(ctx, "logzio_max_bulk_records")
+	if maxBulkRecordsStr != "" {
+		maxBulkRecords, err = strconv.Atoi(maxBulkRecordsStr)
+		if err != nil || maxBulkRecords < 0 {
+			instanceLogger.Warn(fmt.Sprintf("Failed to parse logzio_max_bulk_records ('%s'). Bulk records are not limited.", maxBulkRecordsStr))
+			maxBulkRecords = 0
+		}
+	}
+
+	// Shutdown Config
+	shutdownTimeout := defaultShutdownTimeout
+	shutdownTimeoutStr := plugin.Environment(ctx, "logzio_shutdown_timeout")
+	if shutdownTimeoutStr != "" {
+		shutdownTimeout, err = time.ParseDuration(shutdownTimeoutStr)
+		if err != nil || shutdownTimeout <= 0 {
+			instanceLogger.Warn(fmt.Sprintf("Failed to parse logzio_shutdown_timeout ('%s'). Using default: %s.", shutdownTimeoutStr, defaultShutdownTimeout))
+			shutdownTimeout = defaultShutdownTimeout
+		}
+	}
+	storagePath := plugin.Environment(ctx, "logzio_storage_path")
+	if storagePath != "" {
+		storagePath = filepath.Join(storagePath, outputId)
+	}
 
 	// Create Client
 	clientOptions := []ClientOptionFunc{
+		SetLogger(instanceLogger),
 		SetURL(listenerURL),
 		SetDebug(debug), 
 		SetProxy(proxyHost, proxyUser, proxyPass),
 		SetHeaders(headers),
+		SetFlushInterval(flushInterval),
+		SetMaxBulkRecords(maxBulkRecords),
 	}
 	if bulkSizeOption != nil {
 		clientOptions = append(clientOptions, bulkSizeOption)
 	}
+	if storagePath != "" {
+		clientOptions = append(clientOptions, SetStoragePath(storagePath))
+	}
+	if deadLetterPath := plugin.Environment(ctx, "logzio_dead_letter_path"); deadLetterPath != "" {
+		clientOptions = append(clientOptions, SetDeadLetterPath(deadLetterPath))
+	}
 
 	client, err := NewClient(token, clientOptions...)
 	if err != nil {
 		return fmt.Errorf("failed to create LogzioClient: %w", err)
 	}
-	client.logger = instanceLogger
 
-	outputs[outputId] = &LogzioOutput{
-		logger:            instanceLogger,
-		client:            client,
-		ltype:             ltype,
-		id:                outputId,
-		dedotEnabled:      dedotEnabled,
-		dedotNested:       dedotNested,
-		dedotNewSeparator: dedotNewSeparator,
-		headers:           headers,
+	// Routing Config
+	ltypeTemplate, err := compileLogType(ltype)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("invalid logzio_type: %w", err)
+	}
+	mainRoute := &route{name: defaultRouteName, client: client, ltype: ltype, ltypeTemplate: ltypeTemplate}
+	newRouteClient := func(routeToken string, routeURL string) (*LogzioClient, error) {
+		return NewClient(routeToken, append(clientOptions, SetURL(routeURL))...)
+	}
+	tagRoutes, err := loadTagRoutes(ctx, mainRoute, newRouteClient)
+	if err != nil {
+		client.Close()
+		return err
 	}
+	fieldRules, err := loadFieldRules(ctx, mainRoute, newRouteClient)
+	if err != nil {
+		client.Close()
+		closeTagRoutes(tagRoutes)
+		return err
+	}
+	instanceLogger.Debug(fmt.Sprintf("Loaded %d tag routes and %d field rules.", len(tagRoutes), len(fieldRules)))
+
+	registerOutput(&LogzioOutput{
+		logger:             instanceLogger,
+		client:             client,
+		ltype:              ltype,
+		id:                 outputId,
+		dedotEnabled:       dedotEnabled,
+		dedotNested:        dedotNested,
+		dedotNewSeparator:  dedotNewSeparator,
+		headers:            headers,
+		shutdownTimeout:    shutdownTimeout,
+		mainRoute:          mainRoute,
+		tagRoutes:          tagRoutes,
+		fieldRules:         fieldRules,
+		counters:           NewCounters(),
+		addedFields:        addedFields,
+		addFieldsOverwrite: addFieldsOverwrite,
+		fieldFilter:        fieldFilter,
+		fieldRenamer:       fieldRenamer,
+		redactor:           redactor,
+		flattener:          flattener,
+		fieldExpander:      fieldExpander,
+		logfmtParser:       logfmtParser,
+		levelNormalizer:    levelNormalizer,
+		timeParser:         timeParser,
+		timestampWriter:    timestampWriter,
+		metadataKey:        strings.TrimSpace(plugin.Environment(ctx, "logzio_metadata_key")),
+		groupKey:           strings.TrimSpace(plugin.Environment(ctx, "logzio_group_key")),
+		utf8Policy:         utf8Policy,
+		limits:             limits,
+		schema:             schema,
+		keySanitizer:       keySanitizer,
+	})
 
 	instanceLogger.Debug("Initialization successful.")
 	return nil
 }
 
 func serializeRecord(ts interface{}, tag string, record map[interface{}]interface{}, instance *LogzioOutput) ([]byte, error) {
-	body := parseJSON(record, instance.dedotEnabled, instance.dedotNested, instance.dedotNewSeparator)
+	serialized, _, err := serializeRoutedRecord(ts, tag, record, instance)
+	return serialized, err
+}
 
-	body["@timestamp"] = formatTimestamp(ts) 
-	body["fluentbit_tag"] = tag
+// serializeRoutedRecord serializes the record for the route it should be sent to.
+// A panic while serializing is returned as an error, so a malformed record can't crash Fluent Bit.
+func serializeRoutedRecord(ts interface{}, tag string, record map[interface{}]interface{}, instance *LogzioOutput) (serialized []byte, destination *route, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			serialized, destination, err = nil, nil, fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+	return buildRoutedRecord(ts, tag, record, instance)
+}
 
-	if _, ok := body["type"]; !ok {
-		body["type"] = instance.ltype 
+func buildRoutedRecord(ts interface{}, tag string, record map[interface{}]interface{}, instance *LogzioOutput) ([]byte, *route, error) {
+	parser := instance.newRecordParser()
+	body := parseJSON(record, parser)
+	instance.expandFields(body, parser)
+	instance.parseLogfmtField(body, parser)
+	instance.counters.Add("fields.removed", parser.removedFields)
+	instance.counters.Add("keys.sanitized", parser.sanitizedKeys)
+	if parser.invalidUTF8Fields > 0 {
+		instance.counters.Add("records.invalid_utf8", 1)
+		instance.counters.Add("fields.invalid_utf8", parser.invalidUTF8Fields)
+	}
+	instance.renameFields(body)
+	instance.addFields(body)
+	instance.normalizeLevel(body)
+	timestamp := instance.recordTime(ts, body)
+	instance.redactFields(body)
+	instance.enforceSchema(body)
+	destination := instance.routeForRecord(tag, body)
+	instance.counters.Add("route."+destination.name+".records", 1)
+	// The type and host of the record are limited like its other fields, and the ones the plugin writes are kept
+	var written []string
+	logType, hasType := body["type"]
+	if !hasType {
+		logType = destination.logType(body, tag)
+		written = append(written, "type")
+	}
+	if instance.flattener != nil {
+		body = instance.flattener.flatten(body)
+	}
+	var truncation *truncation
+	if instance.limits != nil {
+		truncation = instance.limits.apply(body)
+		if len(truncation.paths) > 0 {
+			body[truncatedKey] = truncation.paths
+		}
+	}
+	if !hasType {
+		body["type"] = logType
 	}
+
+	instance.timestampWriter.write(body, timestamp)
+	body["fluentbit_tag"] = tag
 	body["output_id"] = instance.id
 
 	if _, ok := body["host"]; !ok {
@@ -341,58 +729,148 @@ func serializeRecord(ts interface{}, tag string, record map[interface{}]interfac
 			hostname = "unknown_host"
 		}
 		body["host"] = hostname
+		written = append(written, "host")
 	}
 
 	serialized, err := jsoniter.Marshal(body)
 	if err != nil {
 		instance.logger.Log(fmt.Sprintf("Failed to marshal record map to JSON: %v", err))
-		return nil, fmt.Errorf("failed marshal record: %w", err) // Wrap error
+		return nil, nil, fmt.Errorf("failed marshal record: %w", err) // Wrap error
+	}
+	if instance.limits != nil && instance.limits.maxRecordBytes > 0 && len(serialized) > instance.limits.maxRecordBytes {
+		serialized, err = instance.limits.fit(body, serialized, truncation, written...)
+		if err != nil {
+			instance.counters.Add("records.oversized_dropped", 1)
+			return nil, nil, err
+		}
+	}
+	if truncation != nil && truncation.fields > 0 {
+		instance.counters.Add("records.truncated", 1)
+		instance.counters.Add("fields.truncated", truncation.fields)
+	}
+
+	return serialized, destination, nil
+}
+
+// recordParser holds the options of parseJSON and the fields it removed from the record.
+type recordParser struct {
+	dedotEnabled      bool
+	dedotNested       bool
+	dedotNewSeparator string
+	filter            *fieldFilter
+	utf8              *utf8Policy
+	keys              *keySanitizer
+	removedFields     int
+	invalidUTF8Fields int
+	sanitizedKeys     int
+}
+
+func (instance *LogzioOutput) newRecordParser() *recordParser {
+	return &recordParser{
+		dedotEnabled:      instance.dedotEnabled,
+		dedotNested:       instance.dedotNested,
+		dedotNewSeparator: instance.dedotNewSeparator,
+		filter:            instance.fieldFilter,
+		utf8:              instance.utf8Policy,
+		keys:              instance.keySanitizer,
 	}
+}
 
-	return serialized, nil
+func parseJSON(record map[interface{}]interface{}, parser *recordParser) map[string]interface{} {
+	return parser.parseMap(record, nil, 0, !parser.filter.hasIncludes())
 }
 
-func parseJSON(record map[interface{}]interface{}, dedotEnabled bool, dedotNested bool, dedotNewSeparator string) map[string]interface{} {
+// parseMap converts a msgpack map. path holds the original keys leading to the map, and is only tracked
+// when fields are filtered. included is false while the map is only an ancestor of included fields.
+func (parser *recordParser) parseMap(record map[interface{}]interface{}, path []string, depth int, included bool) map[string]interface{} {
 	jsonRecord := make(map[string]interface{})
+	dedot := parser.dedotEnabled && (depth == 0 || parser.dedotNested)
+	var renamed map[string]string
+	if parser.keys != nil {
+		renamed = make(map[string]string)
+	}
 
 	for k, v := range record {
-		stringKey := k.(string)
-		if dedotEnabled {
-			regex := regexp.MustCompile("\\.")
-			stringKey = regex.ReplaceAllString(stringKey, dedotNewSeparator)
-		}
-
-		switch t := v.(type) {
-		case []byte:
-			// prevent encoding to base64
-			jsonRecord[stringKey] = string(t)
-		case map[interface{}]interface{}:
-			if !dedotNested {
-				dedotEnabled = false
+		key := keyString(k)
+		if !utf8.ValidString(key) {
+			key = strings.ToValidUTF8(key, "\uFFFD")
+		}
+		original := key
+		childIncluded := included
+		var childPath []string
+		if parser.filter != nil || parser.utf8.hasRules() {
+			childPath = append(path, key)
+		}
+		if parser.filter != nil {
+			if parser.filter.excluded(childPath) {
+				parser.removedFields++
+				continue
 			}
-			jsonRecord[stringKey] = parseJSON(t, dedotEnabled, dedotNested, dedotNewSeparator)
-		case []interface{}:
-			var array []interface{}
-			for _, e := range v.([]interface{}) {
-				switch t := e.(type) {
-				case []byte:
-					array = append(array, string(t))
-				case map[interface{}]interface{}:
-					if !dedotNested {
-						dedotEnabled = false
-					}
-					array = append(array, parseJSON(t, dedotEnabled, dedotNested, dedotNewSeparator))
-				default:
-					array = append(array, e)
+			if !included {
+				var ancestor bool
+				childIncluded, ancestor = parser.filter.inclusion(childPath)
+				if !childIncluded && !ancestor {
+					parser.removedFields++
+					continue
 				}
 			}
-			jsonRecord[stringKey] = array
-		default:
-			jsonRecord[stringKey] = v
+		}
+
+		value, keep := parser.parseValue(v, childPath, depth+1, childIncluded)
+		if !keep {
+			parser.removedFields++
+			continue
+		}
+		if dedot {
+			key = strings.ReplaceAll(key, ".", parser.dedotNewSeparator)
+		}
+		if parser.keys != nil {
+			key = parser.placeKey(jsonRecord, renamed, original, parser.keys.sanitize(key))
+		}
+		value, keep, base64Value := parser.sanitizeField(value, childPath)
+		if base64Value != "" {
+			jsonRecord[key+base64FieldSuffix] = base64Value
+		}
+		if keep {
+			jsonRecord[key] = value
 		}
 	}
 	return jsonRecord
 }
+
+// parseValue converts a msgpack value. Values that are only ancestors of included fields
+// are kept when some of their nested fields are included.
+func (parser *recordParser) parseValue(v interface{}, path []string, depth int, included bool) (interface{}, bool) {
+	switch t := v.(type) {
+	case []byte:
+		// prevent encoding to base64
+		return string(t), included
+	case map[interface{}]interface{}:
+		nested := parser.parseMap(t, path, depth, included)
+		return nested, included || len(nested) > 0
+	case map[string]interface{}:
+		converted := make(map[interface{}]interface{}, len(t))
+		for key, value := range t {
+			converted[key] = value
+		}
+		return parser.parseValue(converted, path, depth, included)
+	case []interface{}:
+		var array []interface{}
+		for _, e := range t {
+			value, keep := parser.parseValue(e, path, depth, included)
+			if keep {
+				value, keep = parser.sanitizeElement(value, path)
+			}
+			if keep {
+				array = append(array, value)
+			}
+		}
+		return array, included || len(array) > 0
+	default:
+		return jsonScalar(v), included
+	}
+}
+
 func formatTimestamp(ts interface{}) time.Time {
 	var timestamp time.Time
 
@@ -401,6 +879,12 @@ func formatTimestamp(ts interface{}) time.Time {
 		timestamp = ts.(output.FLBTime).Time
 	case uint64:
 		timestamp = time.Unix(int64(t), 0)
+	case int64:
+		timestamp = time.Unix(t, 0)
+	case float64:
+		// Forward protocol clients may send the event time as fractional seconds
+		seconds, fraction := math.Modf(t)
+		timestamp = time.Unix(int64(seconds), int64(math.Round(fraction*1e9)))
 	case time.Time:
 		timestamp = ts.(time.Time)
 	case []interface{}:
@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 	"unsafe"
@@ -36,7 +40,7 @@ func (p *TestPluginMock) Environment(ctx unsafe.Pointer, key string) string {
 	return ""
 }
 func (p *TestPluginMock) Unregister(ctx unsafe.Pointer) {}
-func (p *TestPluginMock) NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder { return nil }
+func (p *TestPluginMock) NewDecoder(data unsafe.Pointer, length int) *eventDecoder { return nil }
 func (p *TestPluginMock) Flush(client *LogzioClient) int {
 	return output.FLB_OK
 }
@@ -44,13 +48,13 @@ func (p *TestPluginMock) Send(logBytes []byte, client *LogzioClient) int {
 	p.sentLogs = append(p.sentLogs, logBytes)
 	return output.FLB_OK
 }
-func (p *TestPluginMock) GetRecord(dec *output.FLBDecoder) (int, interface{}, map[interface{}]interface{}) {
+func (p *TestPluginMock) GetRecord(dec *eventDecoder) (int, logEvent) {
 	if p.recCounter >= len(p.records) {
-		return -1, nil, nil
+		return eventEnd, logEvent{}
 	}
 	record := p.records[p.recCounter]
 	p.recCounter++
-	return 0, output.FLBTime{Time: time.Now()}, record
+	return eventOK, logEvent{timestamp: output.FLBTime{Time: time.Now()}, record: record}
 }
 func NewTestPluginMock(config map[string]string, records []map[interface{}]interface{}) *TestPluginMock {
 	return &TestPluginMock{config: config, records: records}
@@ -81,14 +85,14 @@ func TestSerializeRecord(test *testing.T) {
 func TestPluginInitializationBasic(test *testing.T) {
 	mockMissingToken := NewTestPluginMock(map[string]string{"id": testId}, nil)
 	plugin = mockMissingToken
-	err := initConfigParams(unsafe.Pointer(uintptr(0)))
+	err := initConfigParams(nil)
 	require.Error(test, err)
 	require.EqualError(test, err, "required parameter 'logzio_token' is missing")
 
 	mockValid := NewTestPluginMock(map[string]string{"logzio_token": testToken, "id": testId}, nil)
 	plugin = mockValid
 	outputs = nil
-	err = initConfigParams(unsafe.Pointer(uintptr(0)))
+	err = initConfigParams(nil)
 	require.NoError(test, err)
 	require.NotNil(test, outputs)
 	instance, ok := outputs[testId]
@@ -106,7 +110,7 @@ func TestPluginInitializationBulkSize(test *testing.T) {
 	}, nil)
 	plugin = mockValidSize
 	outputs = nil
-	err := initConfigParams(unsafe.Pointer(uintptr(0)))
+	err := initConfigParams(nil)
 	require.NoError(test, err)
 	require.NotNil(test, outputs[testId])
 	require.Equal(test, 5*megaByte, outputs[testId].client.sizeThresholdInBytes)
@@ -118,7 +122,7 @@ func TestPluginInitializationBulkSize(test *testing.T) {
 	}, nil)
 	plugin = mockInvalidSize
 	outputs = nil
-	err = initConfigParams(unsafe.Pointer(uintptr(0)))
+	err = initConfigParams(nil)
 	require.NoError(test, err)
 	require.NotNil(test, outputs[testId])
 	require.Equal(test, defaultSizeThresholdMB*megaByte, outputs[testId].client.sizeThresholdInBytes)
@@ -130,7 +134,7 @@ func TestPluginInitializationBulkSize(test *testing.T) {
 	}, nil)
 	plugin = mockTooLowSize
 	outputs = nil
-	err = initConfigParams(unsafe.Pointer(uintptr(0)))
+	err = initConfigParams(nil)
 	require.NoError(test, err)
 	require.NotNil(test, outputs[testId])
 	require.Equal(test, defaultSizeThresholdMB*megaByte, outputs[testId].client.sizeThresholdInBytes)
@@ -142,7 +146,7 @@ func TestPluginInitializationBulkSize(test *testing.T) {
 	}, nil)
 	plugin = mockTooHighSize
 	outputs = nil
-	err = initConfigParams(unsafe.Pointer(uintptr(0)))
+	err = initConfigParams(nil)
 	require.NoError(test, err)
 	require.NotNil(test, outputs[testId])
 	require.Equal(test, defaultSizeThresholdMB*megaByte, outputs[testId].client.sizeThresholdInBytes)
@@ -164,7 +168,7 @@ func TestPluginFlusherMock(test *testing.T) {
 
 	// 2. Initialize the configuration (this populates the global 'outputs' map)
 	outputs = make(map[string]*LogzioOutput) 
-	err := initConfigParams(unsafe.Pointer(uintptr(0)))
+	err := initConfigParams(nil)
 	require.NoError(test, err)
 	require.Contains(test, outputs, testId) 
 	outputInstance := outputs[testId]  
@@ -172,7 +176,8 @@ func TestPluginFlusherMock(test *testing.T) {
 	// 3. Simulate the core logic of FLBPluginFlushCtx: Iterate records -> Serialize -> Send
 	tag := "test.tag"
 	for {
-		ret, ts, record := mockPlugin.GetRecord(nil) 
+		ret, event := mockPlugin.GetRecord(nil)
+		ts, record := event.timestamp, event.record
 		if ret != 0 {
 			break 
 		}
@@ -195,4 +200,130 @@ func TestPluginFlusherMock(test *testing.T) {
 	require.Equal(test, "log 1", log1Data["message"])
 	require.Equal(test, testType, log1Data["type"])
 	require.Equal(test, testId, log1Data["output_id"])
-}
\ No newline at end of file
+}
+func TestPluginExitDrainsOutputs(test *testing.T) {
+	received := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logs, err := readLogs(r)
+		require.NoError(test, err)
+		received += len(logs)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":            testToken,
+		"id":                      testId,
+		"logzio_url":              testServer.URL,
+		"logzio_shutdown_timeout": "2s",
+	}, nil)
+	outputs = nil
+	err := initConfigParams(nil)
+	require.NoError(test, err)
+	outputInstance := outputs[testId]
+	require.Equal(test, 2*time.Second, outputInstance.shutdownTimeout)
+	require.Equal(test, output.FLB_OK, outputInstance.client.Send([]byte(`{"message":"pending"}`)))
+
+	require.Equal(test, output.FLB_OK, FLBPluginExit())
+	require.Equal(test, 1, received)
+	require.Equal(test, uint64(1), outputInstance.client.counters.Get("records.sent"))
+	require.Equal(test, output.FLB_RETRY, outputInstance.client.Send([]byte(`{"message":"late"}`)))
+}
+
+func TestPluginExitPersistsPendingRecordsAfterTimeout(test *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A listener slower than the shutdown timeout. Reading the body lets the server see the client cancel.
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	storagePath := test.TempDir()
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":            testToken,
+		"id":                      testId,
+		"logzio_url":              testServer.URL,
+		"logzio_shutdown_timeout": "50ms",
+		"logzio_storage_path":     storagePath,
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	outputInstance := outputs[testId]
+	require.Equal(test, output.FLB_OK, outputInstance.client.Send([]byte(`{"message":"pending"}`)))
+
+	start := time.Now()
+	require.Equal(test, output.FLB_OK, FLBPluginExit())
+	require.Less(test, time.Since(start), 2*time.Second)
+
+	files, err := filepath.Glob(filepath.Join(storagePath, testId, "pending-*.ndjson"))
+	require.NoError(test, err)
+	require.Len(test, files, 1)
+	require.Equal(test, uint64(1), outputInstance.client.counters.Get("records.persisted"))
+}
+
+func TestExitOutputRemovesInstance(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":          testToken,
+		"id":                    testId,
+		"logzio_flush_interval": "1h",
+	}, nil)
+	outputs = nil
+	err := initConfigParams(nil)
+	require.NoError(test, err)
+	outputInstance := outputs[testId]
+
+	require.Equal(test, output.FLB_OK, exitOutput(testId))
+	require.NotContains(test, outputs, testId)
+	select {
+	case <-outputInstance.client.flusherDone:
+	default:
+		test.Fatal("interval flusher was not stopped")
+	}
+	require.Equal(test, output.FLB_ERROR, exitOutput(testId))
+}
+
+func TestPluginReinitializationHandsOverPendingRecords(test *testing.T) {
+	config := map[string]string{"logzio_token": testToken, "id": testId}
+	plugin = NewTestPluginMock(config, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	previous := outputs[testId]
+	require.Equal(test, output.FLB_OK, previous.client.Send([]byte(`{"message":"pending"}`)))
+
+	require.NoError(test, initConfigParams(nil))
+	current := outputs[testId]
+	require.NotSame(test, previous, current)
+	require.Len(test, outputs, 1)
+	require.Equal(test, "{\"message\":\"pending\"}\n", string(current.client.bulk))
+	require.Equal(test, 1, current.client.bulkRecords)
+	require.Empty(test, previous.client.bulk)
+	require.Equal(test, output.FLB_RETRY, previous.client.Send([]byte(`{"message":"late"}`)))
+}
+
+func TestParseJSONDedot(test *testing.T) {
+	record := map[interface{}]interface{}{
+		"a.b":   map[interface{}]interface{}{"c.d": "nested"},
+		"e.f":   "top",
+		"g.h":   []interface{}{map[interface{}]interface{}{"i.j": []byte("bytes")}},
+		"k.l.m": "top",
+		"n.o":   map[interface{}]interface{}{"p": "q"},
+		"plain": "value",
+	}
+	body := parseJSON(record, &recordParser{dedotEnabled: true, dedotNewSeparator: "_"})
+	require.Equal(test, map[string]interface{}{
+		"a_b":   map[string]interface{}{"c.d": "nested"},
+		"e_f":   "top",
+		"g_h":   []interface{}{map[string]interface{}{"i.j": "bytes"}},
+		"k_l_m": "top",
+		"n_o":   map[string]interface{}{"p": "q"},
+		"plain": "value",
+	}, body)
+
+	body = parseJSON(record, &recordParser{dedotEnabled: true, dedotNested: true, dedotNewSeparator: "_"})
+	require.Equal(test, map[string]interface{}{"c_d": "nested"}, body["a_b"])
+	require.Equal(test, []interface{}{map[string]interface{}{"i_j": "bytes"}}, body["g_h"])
+}
@@ -0,0 +1,381 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	parseFormatJSON   = "json"
+	parseFormatLogfmt = "logfmt"
+	parseFormatAuto   = "auto"
+
+	parseFailureKeep = "keep"
+	parseFailureDrop = "drop"
+)
+
+// jsonNumbers decodes JSON numbers as json.Number, so big integers keep their precision.
+var jsonNumbers = jsoniter.Config{UseNumber: true}.Froze()
+
+// fieldExpander parses string fields that hold an encoded object, such as the JSON log line of a container runtime.
+type fieldExpander struct {
+	fields       []string
+	format       string
+	target       string
+	onFailure    string
+	keepOriginal bool
+}
+
+// loadFieldExpander reads the field parsing parameters. It returns nil when no field is configured.
+func loadFieldExpander(ctx unsafe.Pointer, logger *Logger) *fieldExpander {
+	expander := &fieldExpander{
+		format:    parseFormatJSON,
+		target:    strings.TrimSpace(plugin.Environment(ctx, "logzio_parse_target")),
+		onFailure: parseFailureKeep,
+	}
+	for _, field := range strings.Split(plugin.Environment(ctx, "logzio_parse_fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			expander.fields = append(expander.fields, field)
+		}
+	}
+	if len(expander.fields) == 0 {
+		return nil
+	}
+
+	switch format := plugin.Environment(ctx, "logzio_parse_format"); format {
+	case "", parseFormatJSON:
+	case parseFormatLogfmt, parseFormatAuto:
+		expander.format = format
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_parse_format value '%s'. Using default: %s.", format, parseFormatJSON))
+	}
+	switch onFailure := plugin.Environment(ctx, "logzio_parse_on_failure"); onFailure {
+	case "", parseFailureKeep:
+	case parseFailureDrop:
+		expander.onFailure = onFailure
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_parse_on_failure value '%s'. Using default: %s.", onFailure, parseFailureKeep))
+	}
+	expander.keepOriginal = plugin.Environment(ctx, "logzio_parse_keep_original") == "true"
+	return expander
+}
+
+// expand parses the configured fields of the record body and returns the number of parsed and failed fields.
+// When parser is set, the parsed values go through it like the fields of the record did.
+func (expander *fieldExpander) expand(body map[string]interface{}, parser *recordParser) (parsed int, failed int) {
+	for _, field := range expander.fields {
+		value, found := lookupField(body, field)
+		encoded, isString := value.(string)
+		if !found || !isString {
+			continue
+		}
+
+		decoded, err := expander.decode(encoded)
+		if err == nil && expander.target == "" {
+			if _, isObject := decoded.(map[string]interface{}); !isObject {
+				err = fmt.Errorf("value is not an object and can't be merged into the record")
+			}
+		}
+		if err != nil {
+			failed++
+			if expander.onFailure == parseFailureDrop {
+				removeField(body, field)
+			}
+			continue
+		}
+
+		if !expander.keepOriginal {
+			removeField(body, field)
+		}
+		if parser != nil {
+			var path []string
+			if expander.target != "" {
+				path = strings.Split(expander.target, ".")
+			}
+			var keep bool
+			if decoded, keep = parser.parseDecoded(decoded, path); !keep {
+				parsed++
+				continue
+			}
+		}
+		if expander.target != "" {
+			setField(body, expander.target, decoded, true)
+		} else {
+			// Fields of the record win over parsed fields with the same name
+			for key, nested := range decoded.(map[string]interface{}) {
+				if _, exists := body[key]; !exists {
+					body[key] = nested
+				}
+			}
+		}
+		parsed++
+	}
+	return parsed, failed
+}
+
+// parseDecoded converts a decoded value as if it were the record field at path, or the record itself when path
+// is empty, so parsed fields get the dedot, key sanitizing, filtering and UTF-8 policy of the record fields.
+func (parser *recordParser) parseDecoded(value interface{}, path []string) (interface{}, bool) {
+	included := !parser.filter.hasIncludes()
+	if parser.filter != nil {
+		for i := range path {
+			if parser.filter.excluded(path[:i+1]) {
+				parser.removedFields++
+				return nil, false
+			}
+		}
+		if !included {
+			var ancestor bool
+			if included, ancestor = parser.filter.inclusion(path); !included && !ancestor {
+				parser.removedFields++
+				return nil, false
+			}
+		}
+	}
+	converted, keep := parser.parseValue(value, path, len(path), included)
+	if keep {
+		converted, keep = parser.sanitizeElement(converted, path)
+	}
+	// The fields merged into the record were counted one by one
+	if !keep && len(path) > 0 {
+		parser.removedFields++
+	}
+	return converted, keep
+}
+
+func (expander *fieldExpander) decode(encoded string) (interface{}, error) {
+	trimmed := strings.TrimSpace(encoded)
+	format := expander.format
+	if format == parseFormatAuto {
+		format = parseFormatLogfmt
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			format = parseFormatJSON
+		}
+	}
+
+	if format == parseFormatLogfmt {
+		return parseLogfmt(trimmed)
+	}
+	var decoded interface{}
+	if err := jsonNumbers.UnmarshalFromString(trimmed, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// parseLogfmt parses key=value pairs separated by spaces. Values may be double quoted,
+// and a key without a value is set to true.
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	return scanLogfmt(line, true, nil)
+}
+
+// scanLogfmt extracts the key=value pairs of a line. When strict is false, words that are not
+// a pair are skipped, e.g. the text of a log message around its pairs, and a quoted value left
+// open ends the scan instead of failing it. When infer is set, it converts the unquoted values.
+func scanLogfmt(line string, strict bool, infer func(string) interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		keyStart := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			if line[i] == '"' {
+				if strict {
+					return nil, fmt.Errorf("unexpected quote in key at position %d", i)
+				}
+				i = skipQuoted(line, i)
+				continue
+			}
+			i++
+		}
+		key := line[keyStart:i]
+		if key == "" || strings.IndexByte(key, '"') >= 0 {
+			if strict {
+				return nil, fmt.Errorf("missing key at position %d", keyStart)
+			}
+			i++
+			continue
+		}
+		if i >= len(line) || line[i] != '=' {
+			if strict {
+				fields[key] = true
+			}
+			continue
+		}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := skipQuoted(line, i) - 1
+			if end >= len(line) || line[end] != '"' || end == i {
+				if strict {
+					return nil, fmt.Errorf("unterminated quoted value of key '%s'", key)
+				}
+				break
+			}
+			value, err := unquoteLogfmt(line[i : end+1])
+			if err != nil {
+				if strict {
+					return nil, fmt.Errorf("malformed quoted value of key '%s': %w", key, err)
+				}
+				i = end + 1
+				continue
+			}
+			fields[key] = value
+			i = end + 1
+			continue
+		}
+
+		valueStart := i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		if infer != nil {
+			fields[key] = infer(line[valueStart:i])
+		} else {
+			fields[key] = line[valueStart:i]
+		}
+	}
+	if strict && len(fields) == 0 {
+		return nil, fmt.Errorf("no key=value pairs found")
+	}
+	return fields, nil
+}
+
+// skipQuoted returns the position after the closing quote of the quoted string starting at start,
+// or the end of the line when the quote is not closed.
+func skipQuoted(line string, start int) int {
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(line)
+}
+
+func unquoteLogfmt(quoted string) (string, error) {
+	var unquoted string
+	if err := jsoniter.UnmarshalFromString(quoted, &unquoted); err != nil {
+		return "", err
+	}
+	return unquoted, nil
+}
+
+// logfmtParser extracts the key=value pairs found in the text of a field, such as the message of a logfmt logger,
+// into fields of the record.
+type logfmtParser struct {
+	field      string
+	prefix     string
+	inferTypes bool
+}
+
+// loadLogfmtParser reads the logfmt parsing parameters. It returns nil when no field is configured.
+func loadLogfmtParser(ctx unsafe.Pointer, logger *Logger) *logfmtParser {
+	field := strings.TrimSpace(plugin.Environment(ctx, "logzio_logfmt_field"))
+	if field == "" {
+		return nil
+	}
+	parser := &logfmtParser{
+		field:      field,
+		prefix:     plugin.Environment(ctx, "logzio_logfmt_prefix"),
+		inferTypes: true,
+	}
+	if inferTypes := plugin.Environment(ctx, "logzio_logfmt_infer_types"); inferTypes != "" {
+		value, err := strconv.ParseBool(inferTypes)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Invalid logzio_logfmt_infer_types value '%s'. Using default: true.", inferTypes))
+		} else {
+			parser.inferTypes = value
+		}
+	}
+	return parser
+}
+
+// extract adds the pairs of the configured field to the record body, without replacing existing fields.
+// When converter is set, the pairs go through it like the fields of the record did. It returns the number
+// of extracted fields.
+func (parser *logfmtParser) extract(body map[string]interface{}, converter *recordParser) int {
+	value, found := lookupField(body, parser.field)
+	line, isString := value.(string)
+	if !found || !isString {
+		return 0
+	}
+
+	var infer func(string) interface{}
+	if parser.inferTypes {
+		infer = inferLogfmtValue
+	}
+	pairs, _ := scanLogfmt(line, false, infer)
+	fields := make(map[string]interface{}, len(pairs))
+	for key, pair := range pairs {
+		fields[parser.prefix+key] = pair
+	}
+	if converter != nil {
+		converted, keep := converter.parseDecoded(fields, nil)
+		if !keep {
+			return 0
+		}
+		fields = converted.(map[string]interface{})
+	}
+	extracted := 0
+	for key, field := range fields {
+		if _, exists := body[key]; exists {
+			continue
+		}
+		body[key] = field
+		extracted++
+	}
+	return extracted
+}
+
+// inferLogfmtValue converts a value to an integer, a float or a boolean when it is one.
+func inferLogfmtValue(text string) interface{} {
+	switch text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return integer
+	}
+	// Only decimal notation, so words like "Inf" or "NaN" stay strings
+	if strings.IndexFunc(text, func(r rune) bool { return (r < '0' || r > '9') && !strings.ContainsRune(".-+eE", r) }) >= 0 {
+		return text
+	}
+	if float, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(float, 0) {
+		return float
+	}
+	return text
+}
+
+// parseLogfmtField applies the configured logfmt parsing to the record body.
+func (instance *LogzioOutput) parseLogfmtField(body map[string]interface{}, parser *recordParser) {
+	if instance.logfmtParser == nil {
+		return
+	}
+	instance.counters.Add("fields.logfmt_extracted", instance.logfmtParser.extract(body, parser))
+}
+
+// expandFields applies the configured field parsing to the record body.
+func (instance *LogzioOutput) expandFields(body map[string]interface{}, parser *recordParser) {
+	if instance.fieldExpander == nil {
+		return
+	}
+	parsed, failed := instance.fieldExpander.expand(body, parser)
+	instance.counters.Add("fields.parsed", parsed)
+	instance.counters.Add("fields.parse_failed", failed)
+}
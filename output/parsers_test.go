@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandJSONField(test *testing.T) {
+	expander := &fieldExpander{fields: []string{"log"}, format: parseFormatJSON, onFailure: parseFailureKeep}
+
+	body := map[string]interface{}{
+		"log":    `{"level":"info","stream":"ignored","request":{"id":12345678901234567890}}`,
+		"stream": "stdout",
+	}
+	parsed, failed := expander.expand(body, nil)
+	require.Equal(test, 1, parsed)
+	require.Equal(test, 0, failed)
+	require.Equal(test, "info", body["level"])
+	require.Equal(test, "stdout", body["stream"])
+	require.NotContains(test, body, "log")
+	request := body["request"].(map[string]interface{})
+	require.Equal(test, json.Number("12345678901234567890"), request["id"])
+
+	// Arrays and scalars can't be merged into the record
+	body = map[string]interface{}{"log": `[1,2]`}
+	parsed, failed = expander.expand(body, nil)
+	require.Equal(test, 0, parsed)
+	require.Equal(test, 1, failed)
+	require.Equal(test, `[1,2]`, body["log"])
+
+	// Non string fields are ignored
+	body = map[string]interface{}{"log": map[string]interface{}{"level": "info"}}
+	parsed, failed = expander.expand(body, nil)
+	require.Equal(test, 0, parsed+failed)
+}
+
+func TestExpandFieldsThroughRecordParser(test *testing.T) {
+	parser := &recordParser{
+		dedotEnabled:      true,
+		dedotNewSeparator: "_",
+		filter:            newFieldFilter("", "password,parsed.secret"),
+		keys:              newTestKeySanitizer(map[string]string{"logzio_key_replace": `" ":_`}),
+	}
+	expander := &fieldExpander{fields: []string{"log"}, format: parseFormatJSON, onFailure: parseFailureKeep}
+	body := map[string]interface{}{"log": `{"log.level":"info","user name":"jane","password":"hunter2","count":3}`}
+	parsed, _ := expander.expand(body, parser)
+	require.Equal(test, 1, parsed)
+	require.Equal(test, map[string]interface{}{"log_level": "info", "user_name": "jane", "count": json.Number("3")}, body)
+	require.Equal(test, 1, parser.removedFields)
+
+	expander.target = "parsed"
+	body = map[string]interface{}{"log": `{"secret":"s","http request":{"a.b":1}}`}
+	expander.expand(body, parser)
+	require.Equal(test, map[string]interface{}{
+		"parsed": map[string]interface{}{"http_request": map[string]interface{}{"a.b": json.Number("1")}},
+	}, body)
+
+	// A target that is excluded as a whole is not added
+	expander.target = "password"
+	body = map[string]interface{}{"log": `{"a":1}`}
+	expander.expand(body, parser)
+	require.Empty(test, body)
+}
+
+func TestExpandFieldTargetAndFailures(test *testing.T) {
+	expander := &fieldExpander{
+		fields:       []string{"kubernetes.annotations.config"},
+		format:       parseFormatJSON,
+		target:       "parsed.config",
+		onFailure:    parseFailureDrop,
+		keepOriginal: true,
+	}
+
+	body := map[string]interface{}{
+		"kubernetes": map[string]interface{}{"annotations": map[string]interface{}{"config": `[1,"a"]`}},
+	}
+	parsed, _ := expander.expand(body, nil)
+	require.Equal(test, 1, parsed)
+	value, found := lookupField(body, "parsed.config")
+	require.True(test, found)
+	require.Len(test, value, 2)
+	_, found = lookupField(body, "kubernetes.annotations.config")
+	require.True(test, found)
+
+	body = map[string]interface{}{
+		"kubernetes": map[string]interface{}{"annotations": map[string]interface{}{"config": `{"broken"`}},
+	}
+	_, failed := expander.expand(body, nil)
+	require.Equal(test, 1, failed)
+	require.NotContains(test, body, "kubernetes")
+	require.NotContains(test, body, "parsed")
+}
+
+func TestExpandAutoFormat(test *testing.T) {
+	expander := &fieldExpander{fields: []string{"message"}, format: parseFormatAuto, onFailure: parseFailureKeep}
+
+	body := map[string]interface{}{"message": `level=warn msg="disk almost full" retry`}
+	parsed, _ := expander.expand(body, nil)
+	require.Equal(test, 1, parsed)
+	require.Equal(test, "warn", body["level"])
+	require.Equal(test, "disk almost full", body["msg"])
+	require.Equal(test, true, body["retry"])
+
+	body = map[string]interface{}{"message": ` {"level":"error"}`}
+	parsed, _ = expander.expand(body, nil)
+	require.Equal(test, 1, parsed)
+	require.Equal(test, "error", body["level"])
+}
+
+func TestParseLogfmt(test *testing.T) {
+	fields, err := parseLogfmt(`a=1 b="x \"y\"" c= d`)
+	require.NoError(test, err)
+	require.Equal(test, map[string]interface{}{"a": "1", "b": `x "y"`, "c": "", "d": true}, fields)
+
+	_, err = parseLogfmt(`a="unterminated`)
+	require.Error(test, err)
+	_, err = parseLogfmt(`=value`)
+	require.Error(test, err)
+	_, err = parseLogfmt(`   `)
+	require.Error(test, err)
+}
+
+func TestLogfmtParser(test *testing.T) {
+	parser := &logfmtParser{field: "message", inferTypes: true}
+
+	body := map[string]interface{}{
+		"message": `GET /health took duration=1.5 status=200 ok=true user="42" ratio=NaN said "a=b" level=warn`,
+		"level":   "info",
+	}
+	extracted := parser.extract(body, nil)
+	require.Equal(test, 5, extracted)
+	require.Equal(test, 1.5, body["duration"])
+	require.Equal(test, int64(200), body["status"])
+	require.Equal(test, true, body["ok"])
+	require.Equal(test, "42", body["user"])
+	require.Equal(test, "NaN", body["ratio"])
+	require.Equal(test, "info", body["level"])
+	require.NotContains(test, body, "a")
+	require.Contains(test, body, "message")
+
+	parser = &logfmtParser{field: "message", prefix: "kv_"}
+	body = map[string]interface{}{"message": `status=200 level=warn`, "level": "info"}
+	require.Equal(test, 2, parser.extract(body, nil))
+	require.Equal(test, "200", body["kv_status"])
+	require.Equal(test, "warn", body["kv_level"])
+	require.Equal(test, "info", body["level"])
+
+	body = map[string]interface{}{"message": `unterminated value="abc`}
+	require.Equal(test, 0, parser.extract(body, nil))
+}
+
+func TestLogfmtParserThroughRecordParser(test *testing.T) {
+	converter := &recordParser{
+		dedotEnabled:      true,
+		dedotNewSeparator: "_",
+		filter:            newFieldFilter("", "password"),
+	}
+	parser := &logfmtParser{field: "message"}
+	body := map[string]interface{}{"message": `login user=bob password=hunter2 a.b=1`}
+	require.Equal(test, 2, parser.extract(body, converter))
+	require.Equal(test, map[string]interface{}{
+		"message": `login user=bob password=hunter2 a.b=1`,
+		"user":    "bob",
+		"a_b":     "1",
+	}, body)
+	require.Equal(test, 1, converter.removedFields)
+}
+
+func TestInferLogfmtValue(test *testing.T) {
+	require.Equal(test, int64(-3), inferLogfmtValue("-3"))
+	require.Equal(test, 1e3, inferLogfmtValue("1e3"))
+	require.Equal(test, false, inferLogfmtValue("false"))
+	require.Equal(test, "Inf", inferLogfmtValue("Inf"))
+	require.Equal(test, "1e999", inferLogfmtValue("1e999"))
+	require.Equal(test, "0x10", inferLogfmtValue("0x10"))
+	require.Equal(test, "", inferLogfmtValue(""))
+}
@@ -0,0 +1,278 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	redactModeMask = "mask"
+	redactModeHash = "hash"
+	redactModeDrop = "drop"
+)
+
+// redactDetector finds sensitive values in strings. validate, when set, filters out false positives of the pattern.
+type redactDetector struct {
+	name     string
+	pattern  *regexp.Regexp
+	validate func(match string) bool
+}
+
+var builtinDetectors = map[string]*redactDetector{
+	"email": {
+		name:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	"credit_card": {
+		name:     "credit_card",
+		pattern:  regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		validate: luhnValid,
+	},
+	"ipv4": {
+		name:    "ipv4",
+		pattern: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`),
+	},
+	"ipv6": {
+		name:    "ipv6",
+		pattern: regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{0,4}|(?:\d{1,3}\.){3}\d{1,3})`),
+		validate: func(match string) bool {
+			return net.ParseIP(match) != nil
+		},
+	},
+	"jwt": {
+		name:    "jwt",
+		pattern: regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	},
+	"aws_key": {
+		name:    "aws_key",
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16}\b`),
+	},
+}
+
+// redactor replaces sensitive values in string fields of the record.
+type redactor struct {
+	detectors []*redactDetector
+	fields    []string
+	mode      string
+	hashKey   []byte
+}
+
+// loadRedactor reads the redaction parameters. It returns nil when no detector or pattern is configured.
+func loadRedactor(ctx unsafe.Pointer, logger *Logger) (*redactor, error) {
+	redactor := &redactor{mode: redactModeMask}
+	for _, name := range strings.Split(plugin.Environment(ctx, "logzio_redact_detectors"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		detector, ok := builtinDetectors[name]
+		if !ok {
+			logger.Warn(fmt.Sprintf("Unknown detector '%s' in logzio_redact_detectors. Skipping.", name))
+			continue
+		}
+		redactor.detectors = append(redactor.detectors, detector)
+	}
+	for i := 1; ; i++ {
+		key := fmt.Sprintf("logzio_redact_pattern_%d", i)
+		expression := plugin.Environment(ctx, key)
+		if expression == "" {
+			break
+		}
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		redactor.detectors = append(redactor.detectors, &redactDetector{name: fmt.Sprintf("pattern_%d", i), pattern: pattern})
+	}
+	if len(redactor.detectors) == 0 {
+		return nil, nil
+	}
+
+	for _, field := range strings.Split(plugin.Environment(ctx, "logzio_redact_fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			redactor.fields = append(redactor.fields, field)
+		}
+	}
+
+	switch mode := plugin.Environment(ctx, "logzio_redact_mode"); mode {
+	case "", redactModeMask:
+	case redactModeHash:
+		hashKey := plugin.Environment(ctx, "logzio_redact_hash_key")
+		if hashKey == "" {
+			return nil, fmt.Errorf("logzio_redact_hash_key is required when logzio_redact_mode is %s", redactModeHash)
+		}
+		redactor.mode, redactor.hashKey = redactModeHash, []byte(hashKey)
+	case redactModeDrop:
+		redactor.mode = redactModeDrop
+	default:
+		return nil, fmt.Errorf("invalid logzio_redact_mode '%s'. Expected %s, %s or %s", mode, redactModeMask, redactModeHash, redactModeDrop)
+	}
+	return redactor, nil
+}
+
+// redact scrubs the configured fields of the record body, or all of its fields when none are configured.
+// Numbers are only checked in the configured fields, as checking every number would redact IDs and epoch
+// timestamps that happen to look like a card number. It returns the number of matches per detector and the
+// number of dropped fields.
+func (redactor *redactor) redact(body map[string]interface{}) (matches map[string]int, dropped int) {
+	matches = make(map[string]int)
+	if len(redactor.fields) == 0 {
+		for key, value := range body {
+			redacted, drop := redactor.redactValue(value, false, matches)
+			if drop {
+				delete(body, key)
+				dropped++
+			} else {
+				body[key] = redacted
+			}
+		}
+		return matches, dropped
+	}
+
+	for _, path := range redactor.fields {
+		value, found := lookupField(body, path)
+		if !found {
+			continue
+		}
+		redacted, drop := redactor.redactValue(value, true, matches)
+		if drop {
+			removeField(body, path)
+			dropped++
+		} else {
+			replaceField(body, path, redacted)
+		}
+	}
+	return matches, dropped
+}
+
+// redactValue returns the value with its sensitive strings, and numbers when numbers is set, replaced,
+// or whether it should be dropped.
+func (redactor *redactor) redactValue(value interface{}, numbers bool, matches map[string]int) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		return redactor.redactString(v, matches)
+	case map[string]interface{}:
+		for key, nested := range v {
+			redacted, drop := redactor.redactValue(nested, numbers, matches)
+			if drop {
+				delete(v, key)
+			} else {
+				v[key] = redacted
+			}
+		}
+		return v, false
+	case []interface{}:
+		kept := v[:0]
+		for _, element := range v {
+			if redacted, drop := redactor.redactValue(element, numbers, matches); !drop {
+				kept = append(kept, redacted)
+			}
+		}
+		return kept, false
+	default:
+		// A card number or an ID logged as a number is as sensitive as its string form
+		text, isNumber := numberString(value)
+		if !numbers || !isNumber {
+			return value, false
+		}
+		redacted, drop := redactor.redactString(text, matches)
+		if drop || redacted != text {
+			return redacted, drop
+		}
+		return value, false
+	}
+}
+
+// numberString returns the decimal form of a number, without an exponent so long digit runs stay intact.
+func numberString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case json.Number:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+func (redactor *redactor) redactString(value string, matches map[string]int) (interface{}, bool) {
+	for _, detector := range redactor.detectors {
+		found := 0
+		value = detector.pattern.ReplaceAllStringFunc(value, func(match string) string {
+			if detector.validate != nil && !detector.validate(match) {
+				return match
+			}
+			found++
+			return redactor.replacement(detector.name, match)
+		})
+		if found == 0 {
+			continue
+		}
+		matches[detector.name] += found
+		if redactor.mode == redactModeDrop {
+			return nil, true
+		}
+	}
+	return value, false
+}
+
+func (redactor *redactor) replacement(detector string, match string) string {
+	if redactor.mode == redactModeHash {
+		mac := hmac.New(sha256.New, redactor.hashKey)
+		mac.Write([]byte(match))
+		return "[HMAC:" + hex.EncodeToString(mac.Sum(nil)[:16]) + "]"
+	}
+	return "[REDACTED:" + detector + "]"
+}
+
+// luhnValid reports whether the digits of a card number candidate pass the Luhn checksum.
+func luhnValid(candidate string) bool {
+	sum, digits := 0, 0
+	for i := len(candidate) - 1; i >= 0; i-- {
+		c := candidate[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if digits%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+// redactFields applies the configured redaction to the record body.
+func (instance *LogzioOutput) redactFields(body map[string]interface{}) {
+	if instance.redactor == nil {
+		return
+	}
+	matches, dropped := instance.redactor.redact(body)
+	for detector, count := range matches {
+		instance.counters.Add("redactions."+detector, count)
+	}
+	instance.counters.Add("fields.redacted_dropped", dropped)
+}
@@ -0,0 +1,115 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// renameConflictSkip leaves both fields in place when the destination exists
+	renameConflictSkip = "skip"
+	// renameConflictOverwrite replaces the destination with the source
+	renameConflictOverwrite = "overwrite"
+	// renameConflictDrop keeps the destination and removes the source
+	renameConflictDrop = "drop"
+)
+
+// renameRule moves the field at a dotted source path to a dotted destination path.
+type renameRule struct {
+	source      string
+	destination string
+}
+
+// fieldRenamer applies rename rules in order, so a rule can use the destination of a previous one.
+type fieldRenamer struct {
+	rules    []renameRule
+	conflict string
+}
+
+// newFieldRenamer parses a "source1:destination1,source2:destination2" list. It returns nil when the list is empty.
+func newFieldRenamer(config string, conflict string, logger *Logger) *fieldRenamer {
+	renamer := &fieldRenamer{conflict: renameConflictSkip}
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			if strings.TrimSpace(pair) != "" {
+				logger.Warn(fmt.Sprintf("Warning: malformed rule '%s' in logzio_rename_fields. Expected format 'source:destination'", pair))
+			}
+			continue
+		}
+		renamer.rules = append(renamer.rules, renameRule{
+			source:      strings.TrimSpace(parts[0]),
+			destination: strings.TrimSpace(parts[1]),
+		})
+	}
+	if len(renamer.rules) == 0 {
+		return nil
+	}
+
+	switch conflict {
+	case "", renameConflictSkip:
+	case renameConflictOverwrite, renameConflictDrop:
+		renamer.conflict = conflict
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_rename_conflict value '%s'. Using default: %s.", conflict, renameConflictSkip))
+	}
+	return renamer
+}
+
+// rename applies the rules to the record body and returns the number of renamed fields and conflicts.
+func (renamer *fieldRenamer) rename(body map[string]interface{}) (renamed int, conflicts int) {
+	for _, rule := range renamer.rules {
+		value, found := lookupField(body, rule.source)
+		if !found {
+			continue
+		}
+		if _, exists := lookupField(body, rule.destination); exists || blockedDestination(body, rule) {
+			conflicts++
+			switch renamer.conflict {
+			case renameConflictSkip:
+				continue
+			case renameConflictDrop:
+				removeField(body, rule.source)
+				continue
+			}
+		}
+		removeField(body, rule.source)
+		if setField(body, rule.destination, value, true) {
+			renamed++
+		}
+	}
+	return renamed, conflicts
+}
+
+// blockedDestination reports whether a parent on the destination path is not an object, e.g. "app" for
+// "app.message" when the record has "app":"web". Only overwrite may replace it. The source itself doesn't
+// block, as it is removed first.
+func blockedDestination(body map[string]interface{}, rule renameRule) bool {
+	segments := strings.Split(rule.destination, ".")
+	current := body
+	for i, segment := range segments[:len(segments)-1] {
+		value, found := current[segment]
+		if !found || strings.Join(segments[:i+1], ".") == rule.source {
+			return false
+		}
+		nested, isMap := value.(map[string]interface{})
+		if !isMap {
+			return true
+		}
+		current = nested
+	}
+	return false
+}
+
+// renameFields applies the configured rename rules to the record body.
+func (instance *LogzioOutput) renameFields(body map[string]interface{}) {
+	if instance.fieldRenamer == nil {
+		return
+	}
+	renamed, conflicts := instance.fieldRenamer.rename(body)
+	instance.counters.Add("fields.renamed", renamed)
+	instance.counters.Add("fields.rename_conflicts", conflicts)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRenameBody() map[string]interface{} {
+	return map[string]interface{}{
+		"msg":     "hello",
+		"lvl":     "info",
+		"message": "existing",
+		"kubernetes": map[string]interface{}{
+			"pod_name": "checkout-1",
+		},
+	}
+}
+
+func TestFieldRenamer(test *testing.T) {
+	logger := NewLogger("testRename", false)
+	renamer := newFieldRenamer("lvl:log_level, kubernetes.pod_name:pod, log_level:meta.level, missing:other, malformed", "", logger)
+	require.Len(test, renamer.rules, 4)
+
+	body := newTestRenameBody()
+	renamed, conflicts := renamer.rename(body)
+	require.Equal(test, 3, renamed)
+	require.Equal(test, 0, conflicts)
+	require.Equal(test, map[string]interface{}{
+		"msg":     "hello",
+		"message": "existing",
+		"pod":     "checkout-1",
+		"meta":    map[string]interface{}{"level": "info"},
+	}, body)
+
+	require.Nil(test, newFieldRenamer("", "", logger))
+}
+
+func TestFieldRenamerConflicts(test *testing.T) {
+	logger := NewLogger("testRename", false)
+
+	body := newTestRenameBody()
+	_, conflicts := newFieldRenamer("msg:message", renameConflictSkip, logger).rename(body)
+	require.Equal(test, 1, conflicts)
+	require.Equal(test, "hello", body["msg"])
+	require.Equal(test, "existing", body["message"])
+
+	body = newTestRenameBody()
+	newFieldRenamer("msg:message", renameConflictOverwrite, logger).rename(body)
+	require.NotContains(test, body, "msg")
+	require.Equal(test, "hello", body["message"])
+
+	body = newTestRenameBody()
+	newFieldRenamer("msg:message", renameConflictDrop, logger).rename(body)
+	require.NotContains(test, body, "msg")
+	require.Equal(test, "existing", body["message"])
+
+	require.Equal(test, renameConflictSkip, newFieldRenamer("msg:message", "invalid", logger).conflict)
+}
+
+func TestFieldRenamerScalarParentConflicts(test *testing.T) {
+	logger := NewLogger("testRename", false)
+	newBody := func() map[string]interface{} {
+		return map[string]interface{}{"app": "web", "msg": "hello"}
+	}
+
+	body := newBody()
+	renamed, conflicts := newFieldRenamer("msg:app.message", renameConflictSkip, logger).rename(body)
+	require.Equal(test, 0, renamed)
+	require.Equal(test, 1, conflicts)
+	require.Equal(test, newBody(), body)
+
+	body = newBody()
+	_, conflicts = newFieldRenamer("msg:app.message", renameConflictDrop, logger).rename(body)
+	require.Equal(test, 1, conflicts)
+	require.Equal(test, map[string]interface{}{"app": "web"}, body)
+
+	body = newBody()
+	renamed, conflicts = newFieldRenamer("msg:app.message", renameConflictOverwrite, logger).rename(body)
+	require.Equal(test, 1, renamed)
+	require.Equal(test, 1, conflicts)
+	require.Equal(test, map[string]interface{}{"app": map[string]interface{}{"message": "hello"}}, body)
+
+	// Moving a field under its own name replaces it, so it is not a conflict
+	body = newBody()
+	renamed, conflicts = newFieldRenamer("msg:msg.text", renameConflictSkip, logger).rename(body)
+	require.Equal(test, 1, renamed)
+	require.Equal(test, 0, conflicts)
+	require.Equal(test, map[string]interface{}{"app": "web", "msg": map[string]interface{}{"text": "hello"}}, body)
+}
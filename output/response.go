@@ -0,0 +1,86 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// Logz.io listener rejects log lines bigger than this size
+	maxLogLineBytes = 500000
+
+	rejectReasonMalformed = "malformed"
+	rejectReasonOversized = "oversized"
+	rejectReasonEmpty     = "empty"
+
+	maxRejectedSamples     = 3
+	maxRejectedSampleBytes = 512
+)
+
+// ListenerResponse is the body the Logz.io listener returns for a bulk request.
+// On a partial failure it reports how many lines were accepted and how many were rejected per reason.
+type ListenerResponse struct {
+	SuccessfulLines int `json:"successfulLines"`
+	MalformedLines  int `json:"malformedLines"`
+	OversizedLines  int `json:"oversizedLines"`
+	EmptyLogLines   int `json:"emptyLogLines"`
+}
+
+// RejectedLines returns the number of lines the listener did not accept.
+func (r *ListenerResponse) RejectedLines() int {
+	return r.MalformedLines + r.OversizedLines + r.EmptyLogLines
+}
+
+// rejectedLine is a line of a bulk that the listener is expected to reject.
+type rejectedLine struct {
+	reason string
+	line   []byte
+}
+
+func parseListenerResponse(body []byte) (*ListenerResponse, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return nil, fmt.Errorf("response body is not a JSON object")
+	}
+	response := &ListenerResponse{}
+	if err := jsoniter.Unmarshal(body, response); err != nil {
+		return nil, fmt.Errorf("failed to parse listener response: %w", err)
+	}
+	return response, nil
+}
+
+// classifyRejectedLines applies the listener validation rules to a bulk,
+// since the listener only reports counts and not which lines it rejected.
+func classifyRejectedLines(bulk []byte) []rejectedLine {
+	var rejected []rejectedLine
+	for len(bulk) > 0 {
+		line := bulk
+		if i := bytes.IndexByte(bulk, '\n'); i >= 0 {
+			line, bulk = bulk[:i], bulk[i+1:]
+		} else {
+			bulk = nil
+		}
+
+		switch {
+		case len(bytes.TrimSpace(line)) == 0:
+			rejected = append(rejected, rejectedLine{reason: rejectReasonEmpty, line: line})
+		case len(line) > maxLogLineBytes:
+			rejected = append(rejected, rejectedLine{reason: rejectReasonOversized, line: line})
+		case !jsoniter.Valid(line):
+			rejected = append(rejected, rejectedLine{reason: rejectReasonMalformed, line: line})
+		}
+	}
+	return rejected
+}
+
+func rejectedSample(line []byte) string {
+	if len(line) > maxRejectedSampleBytes {
+		return fmt.Sprintf("%s... (%d bytes)", line[:maxRejectedSampleBytes], len(line))
+	}
+	return string(line)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenerResponse(test *testing.T) {
+	response, err := parseListenerResponse([]byte(`{"malformedLines":2,"successfulLines":7,"oversizedLines":1,"emptyLogLines":0}`))
+	require.NoError(test, err)
+	require.Equal(test, 7, response.SuccessfulLines)
+	require.Equal(test, 2, response.MalformedLines)
+	require.Equal(test, 1, response.OversizedLines)
+	require.Equal(test, 3, response.RejectedLines())
+
+	_, err = parseListenerResponse([]byte(""))
+	require.Error(test, err)
+	_, err = parseListenerResponse([]byte("Forbidden"))
+	require.Error(test, err)
+}
+
+func TestClassifyRejectedLines(test *testing.T) {
+	oversized := `{"message":"` + strings.Repeat("a", maxLogLineBytes) + `"}`
+	bulk := []byte(`{"message":"ok"}` + "\n" + `{"message":` + "\n" + "\n" + oversized + "\n")
+
+	rejected := classifyRejectedLines(bulk)
+	require.Len(test, rejected, 3)
+	require.Equal(test, rejectReasonMalformed, rejected[0].reason)
+	require.Equal(test, `{"message":`, string(rejected[0].line))
+	require.Equal(test, rejectReasonEmpty, rejected[1].reason)
+	require.Equal(test, rejectReasonOversized, rejected[2].reason)
+}
@@ -0,0 +1,351 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const defaultRouteName = "default"
+
+// route is a Logz.io destination of an output instance. Every route has its own client and bulk.
+type route struct {
+	name          string
+	client        *LogzioClient
+	ltype         string
+	ltypeTemplate *typeTemplate
+}
+
+// tagRoute sends the records of the tags matching its pattern to its route.
+type tagRoute struct {
+	pattern *regexp.Regexp
+	route   *route
+}
+
+// fieldRule sends the records matching all its conditions to its route.
+type fieldRule struct {
+	conditions []*ruleCondition
+	route      *route
+}
+
+// ruleCondition compares the value of a record field. Without an operator, it checks the field exists.
+type ruleCondition struct {
+	path     string
+	operator string
+	value    string
+	pattern  *regexp.Regexp
+	negate   bool
+}
+
+var ruleOperators = []string{"==", "!=", "=~", "!~"}
+
+// newClientFunc creates a client with the output instance options for the given token and listener URL.
+type newClientFunc func(token string, listenerURL string) (*LogzioClient, error)
+
+// loadTagRoutes reads the numbered logzio_route_<N>_* parameters, starting from 1 and stopping at the first
+// number without a match parameter. Token, URL and type default to the output instance values.
+func loadTagRoutes(ctx unsafe.Pointer, defaults *route, newClient newClientFunc) ([]*tagRoute, error) {
+	var tagRoutes []*tagRoute
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("logzio_route_%d_", i)
+		match := plugin.Environment(ctx, prefix+"match")
+		matchRegex := plugin.Environment(ctx, prefix+"match_regex")
+		if match == "" && matchRegex == "" {
+			return tagRoutes, nil
+		}
+
+		var pattern *regexp.Regexp
+		var err error
+		if matchRegex != "" {
+			pattern, err = regexp.Compile(matchRegex)
+		} else {
+			pattern, err = compileTagGlob(match)
+		}
+		if err != nil {
+			closeTagRoutes(tagRoutes)
+			return nil, fmt.Errorf("invalid %smatch pattern: %w", prefix, err)
+		}
+
+		tagRoute := &tagRoute{pattern: pattern}
+		tagRoute.route, err = loadRoute(ctx, fmt.Sprintf("route_%d", i), prefix, defaults, newClient)
+		if err != nil {
+			closeTagRoutes(tagRoutes)
+			return nil, err
+		}
+		tagRoutes = append(tagRoutes, tagRoute)
+	}
+}
+
+// loadRoute reads the token, URL and type parameters with the given prefix into a new route.
+func loadRoute(ctx unsafe.Pointer, name string, prefix string, defaults *route, newClient newClientFunc) (*route, error) {
+	token := plugin.Environment(ctx, prefix+"token")
+	if token == "" {
+		token = defaults.client.token
+	}
+	listenerURL := plugin.Environment(ctx, prefix+"url")
+	if listenerURL == "" {
+		listenerURL = defaults.client.listenerURL
+	}
+	ltype := plugin.Environment(ctx, prefix+"type")
+	if ltype == "" {
+		ltype = defaults.ltype
+	}
+
+	ltypeTemplate, err := compileLogType(ltype)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %stype: %w", prefix, err)
+	}
+	client, err := newClient(token, listenerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LogzioClient for %s: %w", name, err)
+	}
+	return &route{name: name, client: client, ltype: ltype, ltypeTemplate: ltypeTemplate}, nil
+}
+
+// compileLogType returns the template of a log type with references, or nil for a static log type.
+func compileLogType(ltype string) (*typeTemplate, error) {
+	if !isTemplate(ltype) {
+		return nil, nil
+	}
+	return parseTypeTemplate(ltype)
+}
+
+// logType returns the log type of a record sent through the route.
+// A template that can't be resolved for the record falls back to the default log type.
+func (outputRoute *route) logType(body map[string]interface{}, tag string) string {
+	if outputRoute.ltypeTemplate == nil {
+		return outputRoute.ltype
+	}
+	if ltype, ok := outputRoute.ltypeTemplate.render(body, tag); ok && ltype != "" {
+		return ltype
+	}
+	return defaultLogType
+}
+
+// loadFieldRules reads the numbered logzio_rule_<N>_* parameters, starting from 1 and stopping at the first
+// number without a when parameter. Token, URL and type default to the output instance values.
+func loadFieldRules(ctx unsafe.Pointer, defaults *route, newClient newClientFunc) ([]*fieldRule, error) {
+	var fieldRules []*fieldRule
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("logzio_rule_%d_", i)
+		when := plugin.Environment(ctx, prefix+"when")
+		if when == "" {
+			return fieldRules, nil
+		}
+
+		conditions, err := parseRuleConditions(when)
+		if err != nil {
+			closeFieldRules(fieldRules)
+			return nil, fmt.Errorf("invalid %swhen expression: %w", prefix, err)
+		}
+
+		fieldRule := &fieldRule{conditions: conditions}
+		fieldRule.route, err = loadRoute(ctx, fmt.Sprintf("rule_%d", i), prefix, defaults, newClient)
+		if err != nil {
+			closeFieldRules(fieldRules)
+			return nil, err
+		}
+		fieldRules = append(fieldRules, fieldRule)
+	}
+}
+
+// parseRuleConditions parses conditions joined by "&&", e.g.
+// kubernetes.namespace_name == "payments" && level =~ "^(error|fatal)$" && trace_id
+func parseRuleConditions(expression string) ([]*ruleCondition, error) {
+	var conditions []*ruleCondition
+	for _, clause := range splitRuleConditions(expression) {
+		condition, err := parseRuleCondition(strings.TrimSpace(clause))
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// splitRuleConditions splits an expression on the "&&" outside quoted values.
+func splitRuleConditions(expression string) []string {
+	var clauses []string
+	start, quoted := 0, false
+	for i := 0; i < len(expression); i++ {
+		switch expression[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '&':
+			if !quoted && strings.HasPrefix(expression[i:], "&&") {
+				clauses = append(clauses, expression[start:i])
+				start = i + 2
+				i++
+			}
+		}
+	}
+	return append(clauses, expression[start:])
+}
+
+func parseRuleCondition(clause string) (*ruleCondition, error) {
+	if clause == "" {
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	opIndex := -1
+	operator := ""
+	for _, candidate := range ruleOperators {
+		if i := strings.Index(clause, candidate); i >= 0 && (opIndex < 0 || i < opIndex) {
+			opIndex, operator = i, candidate
+		}
+	}
+	if opIndex < 0 {
+		condition := &ruleCondition{path: clause}
+		if strings.HasPrefix(clause, "!") {
+			condition.path, condition.negate = strings.TrimSpace(clause[1:]), true
+		}
+		if condition.path == "" {
+			return nil, fmt.Errorf("condition '%s' has no field", clause)
+		}
+		return condition, nil
+	}
+
+	condition := &ruleCondition{
+		path:     strings.TrimSpace(clause[:opIndex]),
+		operator: operator,
+		value:    strings.TrimSpace(clause[opIndex+len(operator):]),
+		negate:   operator[0] == '!',
+	}
+	if condition.path == "" {
+		return nil, fmt.Errorf("condition '%s' has no field", clause)
+	}
+	if strings.HasPrefix(condition.value, `"`) {
+		value, err := strconv.Unquote(condition.value)
+		if err != nil {
+			return nil, fmt.Errorf("condition '%s' has a malformed quoted value: %w", clause, err)
+		}
+		condition.value = value
+	}
+	if operator == "=~" || operator == "!~" {
+		pattern, err := regexp.Compile(condition.value)
+		if err != nil {
+			return nil, fmt.Errorf("condition '%s' has an invalid regex: %w", clause, err)
+		}
+		condition.pattern = pattern
+	}
+	return condition, nil
+}
+
+// matches reports whether the record body satisfies the condition.
+func (condition *ruleCondition) matches(body map[string]interface{}) bool {
+	value, found := lookupField(body, condition.path)
+	if !found {
+		return condition.negate
+	}
+
+	var matched bool
+	switch condition.operator {
+	case "":
+		matched = true
+	case "==", "!=":
+		matched = fieldString(value) == condition.value
+	default:
+		matched = condition.pattern.MatchString(fieldString(value))
+	}
+	return matched != condition.negate
+}
+
+func (fieldRule *fieldRule) matches(body map[string]interface{}) bool {
+	for _, condition := range fieldRule.conditions {
+		if !condition.matches(body) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldString formats a record value for comparisons and templates.
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// compileTagGlob converts a Fluent Bit style match pattern, where '*' matches any sequence of characters, to a regex.
+func compileTagGlob(glob string) (*regexp.Regexp, error) {
+	parts := strings.Split(glob, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+}
+
+func closeTagRoutes(tagRoutes []*tagRoute) {
+	for _, tagRoute := range tagRoutes {
+		tagRoute.route.client.Close()
+	}
+}
+
+func closeFieldRules(fieldRules []*fieldRule) {
+	for _, fieldRule := range fieldRules {
+		fieldRule.route.client.Close()
+	}
+}
+
+// defaultRoute returns the route of the output instance main token, URL and type.
+func (instance *LogzioOutput) defaultRoute() *route {
+	if instance.mainRoute == nil {
+		return &route{name: defaultRouteName, client: instance.client, ltype: instance.ltype}
+	}
+	return instance.mainRoute
+}
+
+// routeForTag returns the first tag route matching the tag, or the default route.
+func (instance *LogzioOutput) routeForTag(tag string) *route {
+	for _, tagRoute := range instance.tagRoutes {
+		if tagRoute.pattern.MatchString(tag) {
+			return tagRoute.route
+		}
+	}
+	return instance.defaultRoute()
+}
+
+// routeForRecord returns the route of the first field rule matching the record,
+// otherwise the route for the record tag.
+func (instance *LogzioOutput) routeForRecord(tag string, body map[string]interface{}) *route {
+	for _, fieldRule := range instance.fieldRules {
+		if fieldRule.matches(body) {
+			return fieldRule.route
+		}
+	}
+	return instance.routeForTag(tag)
+}
+
+// routes returns all the routes of the output instance, starting with the default one.
+func (instance *LogzioOutput) routes() []*route {
+	routes := []*route{instance.defaultRoute()}
+	for _, tagRoute := range instance.tagRoutes {
+		routes = append(routes, tagRoute.route)
+	}
+	for _, fieldRule := range instance.fieldRules {
+		routes = append(routes, fieldRule.route)
+	}
+	return routes
+}
+
+// routeByName returns the route with the given name, or the default route.
+func (instance *LogzioOutput) routeByName(name string) *route {
+	for _, candidate := range instance.routes() {
+		if candidate.name == name {
+			return candidate
+		}
+	}
+	return instance.defaultRoute()
+}
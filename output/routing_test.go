@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileTagGlob(test *testing.T) {
+	pattern, err := compileTagGlob("kube.*.payments")
+	require.NoError(test, err)
+	require.True(test, pattern.MatchString("kube.prod.payments"))
+	require.True(test, pattern.MatchString("kube.a.b.payments"))
+	require.False(test, pattern.MatchString("kube.prod.payments.extra"))
+	require.False(test, pattern.MatchString("kubeXprod.payments"))
+}
+
+func TestTagRouting(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":               testToken,
+		"id":                         testId,
+		"logzio_type":                testType,
+		"logzio_route_1_match":       "dev.*",
+		"logzio_route_1_token":       "devToken",
+		"logzio_route_1_type":        "dev-type",
+		"logzio_route_2_match_regex": "^prod\\.(api|web)$",
+		"logzio_route_2_token":       "prodToken",
+		"logzio_route_2_url":         "https://listener-eu.logz.io:8071",
+		"logzio_route_4_match":       "ignored.*",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+	require.Len(test, instance.tagRoutes, 2)
+
+	devRoute := instance.routeForTag("dev.app")
+	require.Equal(test, "route_1", devRoute.name)
+	require.Equal(test, "devToken", devRoute.client.token)
+	require.Equal(test, defaultURL, devRoute.client.listenerURL)
+
+	prodRoute := instance.routeForTag("prod.api")
+	require.Equal(test, "route_2", prodRoute.name)
+	require.Equal(test, "prodToken", prodRoute.client.token)
+	require.Equal(test, "https://listener-eu.logz.io:8071", prodRoute.client.listenerURL)
+	require.Equal(test, testType, prodRoute.ltype)
+
+	require.Equal(test, defaultRouteName, instance.routeForTag("prod.db").name)
+	require.Equal(test, defaultRouteName, instance.routeForTag("ignored.app").name)
+	require.Len(test, instance.routes(), 3)
+
+	serialized, destination, err := serializeRoutedRecord(time.Now(), "dev.app", map[interface{}]interface{}{"message": "hello"}, instance)
+	require.NoError(test, err)
+	require.Same(test, devRoute, destination)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "dev-type", result["type"])
+}
+
+func TestTagRoutingInvalidRegex(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":               testToken,
+		"id":                         testId,
+		"logzio_route_1_match_regex": "prod.(api",
+	}, nil)
+	outputs = nil
+	err := initConfigParams(nil)
+	require.Error(test, err)
+	require.Contains(test, err.Error(), "logzio_route_1_match")
+	require.NotContains(test, outputs, testId)
+}
+
+func TestRuleConditions(test *testing.T) {
+	body := map[string]interface{}{
+		"level":  "error",
+		"status": 503,
+		"kubernetes": map[string]interface{}{
+			"namespace_name": "payments",
+			"labels":         map[string]interface{}{"app.kubernetes.io/name": "checkout"},
+		},
+	}
+	cases := map[string]bool{
+		`kubernetes.namespace_name == "payments"`:              true,
+		`kubernetes.namespace_name == payments`:                true,
+		`kubernetes.namespace_name != "payments"`:              false,
+		`kubernetes.labels.app.kubernetes.io/name == checkout`: true,
+		`level =~ "^(error|fatal)$" && status == 503`:          true,
+		`level =~ "^(error|fatal)$" && status == 200`:          false,
+		`missing.field == "x"`:                                 false,
+		`missing.field != "x"`:                                 true,
+		`missing.field !~ "x"`:                                 true,
+		`kubernetes.namespace_name`:                            true,
+		`!kubernetes.pod_name`:                                 true,
+		`!level`:                                               false,
+	}
+	for expression, expected := range cases {
+		conditions, err := parseRuleConditions(expression)
+		require.NoError(test, err, expression)
+		rule := &fieldRule{conditions: conditions}
+		require.Equal(test, expected, rule.matches(body), expression)
+	}
+
+	for _, invalid := range []string{"", "== x", `level =~ "("`, `level == "unterminated`, "level == x &&"} {
+		_, err := parseRuleConditions(invalid)
+		require.Error(test, err, invalid)
+	}
+}
+
+func TestRuleConditionsQuotedAnd(test *testing.T) {
+	conditions, err := parseRuleConditions(`msg =~ "a&&b" && level == "say \"&&\"" && trace_id`)
+	require.NoError(test, err)
+	require.Len(test, conditions, 3)
+	require.Equal(test, "a&&b", conditions[0].value)
+	require.Equal(test, `say "&&"`, conditions[1].value)
+	require.Equal(test, "trace_id", conditions[2].path)
+
+	rule := &fieldRule{conditions: conditions[:1]}
+	require.True(test, rule.matches(map[string]interface{}{"msg": "x a&&b y"}))
+	require.False(test, rule.matches(map[string]interface{}{"msg": "a"}))
+}
+
+func TestFieldRuleRouting(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token":         testToken,
+		"id":                   testId,
+		"logzio_route_1_match": "kube.*",
+		"logzio_route_1_type":  "kube",
+		"logzio_rule_1_when":   `kubernetes.namespace_name == "payments"`,
+		"logzio_rule_1_token":  "securityToken",
+		"logzio_rule_1_type":   "payments",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+	require.Len(test, instance.fieldRules, 1)
+	require.Len(test, instance.routes(), 3)
+
+	payments := map[interface{}]interface{}{"kubernetes": map[interface{}]interface{}{"namespace_name": "payments"}}
+	serialized, destination, err := serializeRoutedRecord(time.Now(), "kube.var.log", payments, instance)
+	require.NoError(test, err)
+	require.Equal(test, "rule_1", destination.name)
+	require.Equal(test, "securityToken", destination.client.token)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "payments", result["type"])
+
+	other := map[interface{}]interface{}{"kubernetes": map[interface{}]interface{}{"namespace_name": "default"}}
+	_, destination, err = serializeRoutedRecord(time.Now(), "kube.var.log", other, instance)
+	require.NoError(test, err)
+	require.Equal(test, "route_1", destination.name)
+	_, destination, err = serializeRoutedRecord(time.Now(), "app", other, instance)
+	require.NoError(test, err)
+	require.Equal(test, defaultRouteName, destination.name)
+
+	require.Equal(test, uint64(1), instance.counters.Get("route.rule_1.records"))
+	require.Equal(test, uint64(1), instance.counters.Get("route.route_1.records"))
+	require.Equal(test, uint64(1), instance.counters.Get("route.default.records"))
+}
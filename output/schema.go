@@ -0,0 +1,256 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	schemaString = "string"
+	schemaLong   = "long"
+	schemaDouble = "double"
+	schemaBool   = "bool"
+	schemaObject = "object"
+
+	// schemaCoerce converts mismatched values when possible, and relocates the others
+	schemaCoerce = "coerce"
+	// schemaRelocate relocates all mismatched values
+	schemaRelocate = "relocate"
+)
+
+// schemaField is the expected type of the field at a dotted path.
+type schemaField struct {
+	path      string
+	fieldType string
+}
+
+// fieldSchema keeps the type of record fields stable, so Logz.io doesn't reject records where a field has another
+// type than in the index mapping. A mismatched value that is not coerced moves to a field named after its own type,
+// e.g. a string in a long field "status" moves to "status_str".
+type fieldSchema struct {
+	fields     []schemaField
+	onMismatch string
+}
+
+// loadFieldSchema reads the schema file, a JSON object of dotted field paths to types, e.g.
+// {"status": "long", "request.headers": "object"}. It returns nil when no schema file is configured.
+func loadFieldSchema(ctx unsafe.Pointer, logger *Logger) (*fieldSchema, error) {
+	path := plugin.Environment(ctx, "logzio_schema_file")
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read logzio_schema_file: %w", err)
+	}
+	var types map[string]string
+	if err := jsoniter.Unmarshal(content, &types); err != nil {
+		return nil, fmt.Errorf("invalid logzio_schema_file '%s': %w", path, err)
+	}
+
+	schema := &fieldSchema{onMismatch: schemaCoerce}
+	for fieldPath, fieldType := range types {
+		switch fieldType {
+		case schemaString, schemaLong, schemaDouble, schemaBool, schemaObject:
+		default:
+			return nil, fmt.Errorf("invalid type '%s' of field '%s' in logzio_schema_file. Expected string, long, double, bool or object", fieldType, fieldPath)
+		}
+		schema.fields = append(schema.fields, schemaField{path: fieldPath, fieldType: fieldType})
+	}
+	// Parents before their nested fields, so a relocated object doesn't hide the nested fields
+	sort.Slice(schema.fields, func(i, j int) bool { return schema.fields[i].path < schema.fields[j].path })
+
+	switch onMismatch := plugin.Environment(ctx, "logzio_schema_on_mismatch"); onMismatch {
+	case "", schemaCoerce:
+	case schemaRelocate:
+		schema.onMismatch = onMismatch
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_schema_on_mismatch value '%s'. Using default: %s.", onMismatch, schemaCoerce))
+	}
+	return schema, nil
+}
+
+// schemaResult counts the fields coerced, relocated and dropped by the schema, by field path.
+type schemaResult struct {
+	coerced   []string
+	relocated []string
+	// dropped are the mismatched values whose relocation field already exists in the record
+	dropped []string
+}
+
+// enforce checks the type of the schema fields of the record body.
+func (schema *fieldSchema) enforce(body map[string]interface{}) schemaResult {
+	var result schemaResult
+	for _, field := range schema.fields {
+		value, found := lookupField(body, field.path)
+		if !found || value == nil {
+			continue
+		}
+		if matchesSchemaType(value, field.fieldType) {
+			continue
+		}
+		if schema.onMismatch == schemaCoerce {
+			if coerced, ok := coerceValue(value, field.fieldType); ok {
+				replaceField(body, field.path, coerced)
+				result.coerced = append(result.coerced, field.path)
+				continue
+			}
+		}
+		removeField(body, field.path)
+		if !setField(body, field.path+"_"+schemaSuffix(value, field.fieldType), value, false) {
+			result.dropped = append(result.dropped, field.path)
+			continue
+		}
+		result.relocated = append(result.relocated, field.path)
+	}
+	return result
+}
+
+// matchesSchemaType reports whether the value, or every element of an array value, has the type.
+func matchesSchemaType(value interface{}, fieldType string) bool {
+	if array, isArray := value.([]interface{}); isArray {
+		for _, element := range array {
+			if element != nil && !matchesSchemaType(element, fieldType) {
+				return false
+			}
+		}
+		return true
+	}
+	switch value.(type) {
+	case string:
+		return fieldType == schemaString
+	case bool:
+		return fieldType == schemaBool
+	case map[string]interface{}:
+		return fieldType == schemaObject
+	case float64, float32, json.Number:
+		return fieldType == schemaDouble
+	case int64, int, int32, int16, int8, uint64, uint32, uint16, uint8, uint:
+		// Integers are valid doubles too
+		return fieldType == schemaLong || fieldType == schemaDouble
+	}
+	return false
+}
+
+// coerceValue converts the value, or every element of an array value, to the type.
+func coerceValue(value interface{}, fieldType string) (interface{}, bool) {
+	if array, isArray := value.([]interface{}); isArray {
+		coerced := make([]interface{}, len(array))
+		for i, element := range array {
+			if element == nil || matchesSchemaType(element, fieldType) {
+				coerced[i] = element
+				continue
+			}
+			var ok bool
+			if coerced[i], ok = coerceValue(element, fieldType); !ok {
+				return nil, false
+			}
+		}
+		return coerced, true
+	}
+
+	switch fieldType {
+	case schemaString:
+		switch v := value.(type) {
+		case map[string]interface{}:
+			return nil, false
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		default:
+			return fmt.Sprint(v), true
+		}
+	case schemaLong:
+		return coerceLong(value)
+	case schemaDouble:
+		text, isText := value.(string)
+		if number, isNumber := value.(json.Number); isNumber {
+			text, isText = number.String(), true
+		}
+		if isText {
+			if double, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil && !math.IsInf(double, 0) && !math.IsNaN(double) {
+				return double, true
+			}
+		}
+	case schemaBool:
+		if text, isText := value.(string); isText {
+			switch strings.ToLower(strings.TrimSpace(text)) {
+			case "true":
+				return true, true
+			case "false":
+				return false, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func coerceLong(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			return int64(v), true
+		}
+	case json.Number:
+		if long, err := v.Int64(); err == nil {
+			return long, true
+		}
+	case string:
+		if long, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return long, true
+		}
+	}
+	return nil, false
+}
+
+// schemaSuffix returns the suffix of the field a mismatched value is relocated to, named after the value type.
+func schemaSuffix(value interface{}, fieldType string) string {
+	if array, isArray := value.([]interface{}); isArray {
+		for _, element := range array {
+			if element != nil && !matchesSchemaType(element, fieldType) {
+				return schemaSuffix(element, fieldType)
+			}
+		}
+	}
+	switch value.(type) {
+	case string:
+		return "str"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "obj"
+	case float64, float32, json.Number:
+		return "double"
+	case []interface{}:
+		return "arr"
+	default:
+		return "long"
+	}
+}
+
+// enforceSchema applies the field schema to the record body.
+func (instance *LogzioOutput) enforceSchema(body map[string]interface{}) {
+	if instance.schema == nil {
+		return
+	}
+	result := instance.schema.enforce(body)
+	for _, path := range result.coerced {
+		instance.counters.Add("schema.coerced."+path, 1)
+	}
+	for _, path := range result.relocated {
+		instance.counters.Add("schema.relocated."+path, 1)
+	}
+	for _, path := range result.dropped {
+		instance.counters.Add("schema.dropped."+path, 1)
+	}
+}
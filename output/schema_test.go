@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFieldSchema(test *testing.T, schemaJSON string, config map[string]string) (*fieldSchema, error) {
+	path := filepath.Join(test.TempDir(), "schema.json")
+	require.NoError(test, os.WriteFile(path, []byte(schemaJSON), 0600))
+	if config == nil {
+		config = map[string]string{}
+	}
+	config["logzio_schema_file"] = path
+	plugin = NewTestPluginMock(config, nil)
+	return loadFieldSchema(nil, NewLogger("testSchema", false))
+}
+
+func TestFieldSchemaConfig(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{}, nil)
+	schema, err := loadFieldSchema(nil, NewLogger("testSchema", false))
+	require.NoError(test, err)
+	require.Nil(test, schema)
+
+	_, err = newTestFieldSchema(test, `{"status": "integer"}`, nil)
+	require.Error(test, err)
+	_, err = newTestFieldSchema(test, `["status"]`, nil)
+	require.Error(test, err)
+
+	plugin = NewTestPluginMock(map[string]string{"logzio_schema_file": filepath.Join(test.TempDir(), "missing.json")}, nil)
+	_, err = loadFieldSchema(nil, NewLogger("testSchema", false))
+	require.Error(test, err)
+}
+
+func TestFieldSchemaCoerce(test *testing.T) {
+	schema, err := newTestFieldSchema(test, `{
+		"status": "long",
+		"latency": "double",
+		"ok": "bool",
+		"user.id": "string",
+		"request": "object",
+		"codes": "long",
+		"error": "string",
+		"missing": "long"
+	}`, nil)
+	require.NoError(test, err)
+
+	body := map[string]interface{}{
+		"status":  "200",
+		"latency": json.Number("1.25"),
+		"ok":      "TRUE",
+		"user":    map[string]interface{}{"id": int64(42)},
+		"request": "GET /",
+		"codes":   []interface{}{int64(1), "2", float64(3)},
+		"error":   map[string]interface{}{"code": int64(500)},
+	}
+	result := schema.enforce(body)
+	require.Equal(test, map[string]interface{}{
+		"status":      int64(200),
+		"latency":     json.Number("1.25"),
+		"ok":          true,
+		"user":        map[string]interface{}{"id": "42"},
+		"request_str": "GET /",
+		"codes":       []interface{}{int64(1), int64(2), int64(3)},
+		"error_obj":   map[string]interface{}{"code": int64(500)},
+	}, body)
+	require.ElementsMatch(test, []string{"status", "ok", "user.id", "codes"}, result.coerced)
+	require.ElementsMatch(test, []string{"request", "error"}, result.relocated)
+
+	body = map[string]interface{}{"status": 200.5, "codes": []interface{}{int64(1), "two"}, "latency": "fast"}
+	result = schema.enforce(body)
+	require.Equal(test, map[string]interface{}{
+		"status_double": 200.5,
+		"codes_str":     []interface{}{int64(1), "two"},
+		"latency_str":   "fast",
+	}, body)
+	require.Empty(test, result.coerced)
+}
+
+func TestFieldSchemaRelocate(test *testing.T) {
+	schema, err := newTestFieldSchema(test, `{"status": "long", "nested.flag": "bool"}`, map[string]string{"logzio_schema_on_mismatch": "relocate"})
+	require.NoError(test, err)
+
+	instance := &LogzioOutput{counters: NewCounters(), schema: schema}
+	body := map[string]interface{}{"status": "200", "nested": map[string]interface{}{"flag": int64(1)}}
+	instance.enforceSchema(body)
+	require.Equal(test, map[string]interface{}{
+		"status_str": "200",
+		"nested":     map[string]interface{}{"flag_long": int64(1)},
+	}, body)
+	require.Equal(test, uint64(1), instance.counters.Get("schema.relocated.status"))
+	require.Equal(test, uint64(1), instance.counters.Get("schema.relocated.nested.flag"))
+}
+
+func TestFieldSchemaRelocationTargetExists(test *testing.T) {
+	schema, err := newTestFieldSchema(test, `{"status": "long"}`, map[string]string{"logzio_schema_on_mismatch": "relocate"})
+	require.NoError(test, err)
+
+	instance := &LogzioOutput{counters: NewCounters(), schema: schema}
+	body := map[string]interface{}{"status": "200", "status_str": "record"}
+	instance.enforceSchema(body)
+	require.Equal(test, map[string]interface{}{"status_str": "record"}, body)
+	require.Equal(test, uint64(0), instance.counters.Get("schema.relocated.status"))
+	require.Equal(test, uint64(1), instance.counters.Get("schema.dropped.status"))
+}
@@ -0,0 +1,215 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	defaultLevelTarget  = "log_level"
+	defaultLevelFields  = "log_level,level,lvl,severity,loglevel,LogLevel,severity_text"
+	defaultLevelMessage = "message"
+)
+
+// canonicalLevels are the levels written by the normalization, from the least to the most severe.
+var canonicalLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// levelAliases maps lower case level names to canonical levels.
+var levelAliases = map[string]string{
+	"trace":         "TRACE",
+	"finest":        "TRACE",
+	"debug":         "DEBUG",
+	"dbg":           "DEBUG",
+	"fine":          "DEBUG",
+	"info":          "INFO",
+	"information":   "INFO",
+	"informational": "INFO",
+	"notice":        "INFO",
+	"warn":          "WARN",
+	"warning":       "WARN",
+	"error":         "ERROR",
+	"err":           "ERROR",
+	"fatal":         "FATAL",
+	"critical":      "FATAL",
+	"crit":          "FATAL",
+	"alert":         "FATAL",
+	"emerg":         "FATAL",
+	"emergency":     "FATAL",
+	"panic":         "FATAL",
+}
+
+// syslogLevels maps syslog severity numbers to canonical levels.
+var syslogLevels = []string{"FATAL", "FATAL", "FATAL", "ERROR", "WARN", "INFO", "INFO", "DEBUG"}
+
+// levelNormalizer detects the severity of a record and writes it as a canonical level.
+type levelNormalizer struct {
+	target       string
+	fields       []string
+	messageField string
+	aliases      map[string]string
+}
+
+// loadLevelNormalizer reads the level normalization parameters. It returns nil when the normalization is disabled.
+func loadLevelNormalizer(ctx unsafe.Pointer, logger *Logger) *levelNormalizer {
+	if enabled, _ := strconv.ParseBool(plugin.Environment(ctx, "logzio_level_normalize")); !enabled {
+		return nil
+	}
+	normalizer := &levelNormalizer{
+		target:       strings.TrimSpace(plugin.Environment(ctx, "logzio_level_target")),
+		messageField: strings.TrimSpace(plugin.Environment(ctx, "logzio_level_message_field")),
+		aliases:      make(map[string]string, len(levelAliases)),
+	}
+	if normalizer.target == "" {
+		normalizer.target = defaultLevelTarget
+	}
+	if normalizer.messageField == "" {
+		normalizer.messageField = defaultLevelMessage
+	} else if normalizer.messageField == "-" {
+		normalizer.messageField = ""
+	}
+
+	fields := plugin.Environment(ctx, "logzio_level_fields")
+	if fields == "" {
+		fields = defaultLevelFields
+	}
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			normalizer.fields = append(normalizer.fields, field)
+		}
+	}
+
+	for alias, level := range levelAliases {
+		normalizer.aliases[alias] = level
+	}
+	for _, rule := range strings.Split(plugin.Environment(ctx, "logzio_level_aliases"), ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 {
+			logger.Warn(fmt.Sprintf("Warning: malformed alias '%s' in logzio_level_aliases. Expected format 'alias:LEVEL'", rule))
+			continue
+		}
+		alias, level := strings.ToLower(strings.TrimSpace(parts[0])), strings.ToUpper(strings.TrimSpace(parts[1]))
+		if alias == "" || !isCanonicalLevel(level) {
+			logger.Warn(fmt.Sprintf("Warning: invalid alias '%s' in logzio_level_aliases. Levels are %s.", rule, strings.Join(canonicalLevels, ", ")))
+			continue
+		}
+		normalizer.aliases[alias] = level
+	}
+	return normalizer
+}
+
+func isCanonicalLevel(level string) bool {
+	for _, canonical := range canonicalLevels {
+		if level == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize writes the canonical level of the record body to the target field.
+// It returns false when no level is found.
+func (normalizer *levelNormalizer) normalize(body map[string]interface{}) bool {
+	for _, field := range normalizer.fields {
+		value, found := lookupField(body, field)
+		if !found {
+			continue
+		}
+		if level, ok := normalizer.levelOf(value); ok {
+			setField(body, normalizer.target, level, true)
+			return true
+		}
+	}
+	if normalizer.messageField == "" {
+		return false
+	}
+	message, _ := lookupField(body, normalizer.messageField)
+	text, isString := message.(string)
+	if !isString {
+		return false
+	}
+	if level, ok := normalizer.messageLevel(text); ok {
+		setField(body, normalizer.target, level, true)
+		return true
+	}
+	return false
+}
+
+// levelOf maps a level name or a syslog severity number to a canonical level.
+func (normalizer *levelNormalizer) levelOf(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		name := strings.ToLower(strings.TrimSpace(v))
+		if level, ok := normalizer.aliases[name]; ok {
+			return level, true
+		}
+		if number, err := strconv.ParseInt(name, 10, 64); err == nil {
+			return syslogLevel(number)
+		}
+	case int64:
+		return syslogLevel(v)
+	case uint64:
+		if v < uint64(len(syslogLevels)) {
+			return syslogLevel(int64(v))
+		}
+	case float64:
+		if v == float64(int64(v)) {
+			return syslogLevel(int64(v))
+		}
+	case json.Number:
+		if number, err := v.Int64(); err == nil {
+			return syslogLevel(number)
+		}
+	}
+	return "", false
+}
+
+func syslogLevel(number int64) (string, bool) {
+	if number < 0 || number >= int64(len(syslogLevels)) {
+		return "", false
+	}
+	return syslogLevels[number], true
+}
+
+// messageLevel detects the level in the leading token of a message, e.g. "ERROR: ...", "[warn] ..."
+// or a syslog priority such as "<11>...".
+func (normalizer *levelNormalizer) messageLevel(message string) (string, bool) {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "<") {
+		if end := strings.IndexByte(message, '>'); end > 1 {
+			if priority, err := strconv.ParseInt(message[1:end], 10, 64); err == nil && priority >= 0 {
+				return syslogLevel(priority % 8)
+			}
+		}
+	}
+
+	token := message
+	if end := strings.IndexAny(message, " \t"); end >= 0 {
+		token = message[:end]
+	}
+	token = strings.Trim(token, "[]():|<>-")
+	if level, ok := normalizer.aliases[strings.ToLower(token)]; ok {
+		return level, true
+	}
+	return "", false
+}
+
+// normalizeLevel applies the configured level normalization to the record body.
+func (instance *LogzioOutput) normalizeLevel(body map[string]interface{}) {
+	if instance.levelNormalizer == nil {
+		return
+	}
+	if instance.levelNormalizer.normalize(body) {
+		instance.counters.Add("levels.normalized", 1)
+	} else {
+		instance.counters.Add("levels.undetected", 1)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLevelNormalizer(config map[string]string) *levelNormalizer {
+	plugin = NewTestPluginMock(config, nil)
+	return loadLevelNormalizer(nil, NewLogger("testLevel", false))
+}
+
+func TestLevelNormalizerDisabled(test *testing.T) {
+	require.Nil(test, newTestLevelNormalizer(map[string]string{}))
+}
+
+func TestNormalizeLevelFields(test *testing.T) {
+	normalizer := newTestLevelNormalizer(map[string]string{"logzio_level_normalize": "true"})
+
+	cases := []struct {
+		body     map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"level": "warning"}, "WARN"},
+		{map[string]interface{}{"lvl": " Err "}, "ERROR"},
+		{map[string]interface{}{"LogLevel": "Information"}, "INFO"},
+		{map[string]interface{}{"severity": int64(2)}, "FATAL"},
+		{map[string]interface{}{"severity": float64(7)}, "DEBUG"},
+		{map[string]interface{}{"severity": json.Number("4")}, "WARN"},
+		{map[string]interface{}{"severity": "5"}, "INFO"},
+		{map[string]interface{}{"level": "unknown", "lvl": "trace"}, "TRACE"},
+		{map[string]interface{}{"log_level": "crit", "level": "info"}, "FATAL"},
+		{map[string]interface{}{"message": "[ERROR] connection refused"}, "ERROR"},
+		{map[string]interface{}{"message": "WARN: disk almost full"}, "WARN"},
+		{map[string]interface{}{"message": "<11>Oct 11 22:14:15 host app: failed"}, "ERROR"},
+	}
+	for _, testCase := range cases {
+		require.True(test, normalizer.normalize(testCase.body), "%v", testCase.body)
+		require.Equal(test, testCase.expected, testCase.body["log_level"], "%v", testCase.body)
+	}
+
+	body := map[string]interface{}{"severity": int64(9), "message": "errors were found"}
+	require.False(test, normalizer.normalize(body))
+	require.NotContains(test, body, "log_level")
+}
+
+func TestNormalizeLevelConfig(test *testing.T) {
+	normalizer := newTestLevelNormalizer(map[string]string{
+		"logzio_level_normalize":     "true",
+		"logzio_level_fields":        "meta.sev",
+		"logzio_level_target":        "meta.level",
+		"logzio_level_message_field": "-",
+		"logzio_level_aliases":       "E:error,W:warn,malformed,X:loud",
+	})
+	require.Equal(test, []string{"meta.sev"}, normalizer.fields)
+
+	body := map[string]interface{}{"meta": map[string]interface{}{"sev": "e"}, "level": "info"}
+	require.True(test, normalizer.normalize(body))
+	level, _ := lookupField(body, "meta.level")
+	require.Equal(test, "ERROR", level)
+	require.NotContains(test, normalizer.aliases, "x")
+
+	require.False(test, normalizer.normalize(map[string]interface{}{"message": "ERROR: failed"}))
+}
@@ -0,0 +1,144 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// typeTemplate is a log type with references to record fields and tag parts, e.g. "${kubernetes.labels.app}-${tag[1]}".
+// A reference may list alternatives that are tried in order and end with a default value: "${app|service:-unknown}".
+type typeTemplate struct {
+	parts []templatePart
+}
+
+// templatePart is either a literal or a reference.
+type templatePart struct {
+	literal      string
+	alternatives []templateReference
+	defaultValue string
+	hasDefault   bool
+}
+
+// templateReference is a dotted record field path, the whole tag ("tag"),
+// or a tag part split by dots ("tag[0]", negative indexes count from the end).
+type templateReference struct {
+	path     string
+	isTag    bool
+	tagIndex int
+	wholeTag bool
+}
+
+// isTemplate reports whether the log type contains references.
+func isTemplate(ltype string) bool {
+	return strings.Contains(ltype, "${")
+}
+
+func parseTypeTemplate(ltype string) (*typeTemplate, error) {
+	template := &typeTemplate{}
+	rest := ltype
+	for rest != "" {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			template.parts = append(template.parts, templatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			template.parts = append(template.parts, templatePart{literal: rest[:start]})
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in '%s'", ltype)
+		}
+		part, err := parseTemplateReference(rest[start+2 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference in '%s': %w", ltype, err)
+		}
+		template.parts = append(template.parts, part)
+		rest = rest[start+end+1:]
+	}
+	return template, nil
+}
+
+func parseTemplateReference(expression string) (templatePart, error) {
+	part := templatePart{}
+	if i := strings.Index(expression, ":-"); i >= 0 {
+		part.defaultValue, part.hasDefault = expression[i+2:], true
+		expression = expression[:i]
+	}
+	for _, alternative := range strings.Split(expression, "|") {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == "" {
+			return part, fmt.Errorf("empty reference")
+		}
+		reference := templateReference{path: alternative}
+		if alternative == "tag" {
+			reference.isTag, reference.wholeTag = true, true
+		} else if strings.HasPrefix(alternative, "tag[") && strings.HasSuffix(alternative, "]") {
+			index, err := strconv.Atoi(alternative[len("tag[") : len(alternative)-1])
+			if err != nil {
+				return part, fmt.Errorf("invalid tag index in '%s'", alternative)
+			}
+			reference.isTag, reference.tagIndex = true, index
+		}
+		part.alternatives = append(part.alternatives, reference)
+	}
+	return part, nil
+}
+
+// render evaluates the template for a record. It returns false when a reference
+// without a default value can't be resolved.
+func (template *typeTemplate) render(body map[string]interface{}, tag string) (string, bool) {
+	var builder strings.Builder
+	for _, part := range template.parts {
+		if part.alternatives == nil {
+			builder.WriteString(part.literal)
+			continue
+		}
+		value, ok := part.resolve(body, tag)
+		if !ok {
+			return "", false
+		}
+		builder.WriteString(value)
+	}
+	// Log types can't contain spaces
+	return strings.Join(strings.Fields(builder.String()), "_"), true
+}
+
+func (part *templatePart) resolve(body map[string]interface{}, tag string) (string, bool) {
+	for _, reference := range part.alternatives {
+		if value := reference.resolve(body, tag); value != "" {
+			return value, true
+		}
+	}
+	return part.defaultValue, part.hasDefault
+}
+
+func (reference *templateReference) resolve(body map[string]interface{}, tag string) string {
+	if !reference.isTag {
+		value, ok := lookupField(body, reference.path)
+		if !ok {
+			return ""
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return ""
+		}
+		return fieldString(value)
+	}
+	if reference.wholeTag {
+		return tag
+	}
+	tagParts := strings.Split(tag, ".")
+	index := reference.tagIndex
+	if index < 0 {
+		index += len(tagParts)
+	}
+	if index < 0 || index >= len(tagParts) {
+		return ""
+	}
+	return tagParts[index]
+}
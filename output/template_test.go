@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypeTemplateRender(test *testing.T) {
+	body := map[string]interface{}{
+		"service": "billing",
+		"kubernetes": map[string]interface{}{
+			"labels": map[string]interface{}{"app": "checkout"},
+		},
+	}
+	tag := "kube.prod.payments"
+	cases := map[string]string{
+		"${kubernetes.labels.app}-${tag[1]}":         "checkout-prod",
+		"${missing|service}":                         "billing",
+		"${missing:-unknown}-${tag[-1]}":             "unknown-payments",
+		"static-${tag}":                              "static-kube.prod.payments",
+		"${kubernetes.labels:-object}":               "object",
+		"${kubernetes.labels.app} ${tag[0]}":         "checkout_kube",
+		"${missing|also.missing|tag[7]:-}${service}": "billing",
+	}
+	for ltype, expected := range cases {
+		template, err := parseTypeTemplate(ltype)
+		require.NoError(test, err, ltype)
+		rendered, ok := template.render(body, tag)
+		require.True(test, ok, ltype)
+		require.Equal(test, expected, rendered, ltype)
+	}
+
+	template, err := parseTypeTemplate("${missing}-app")
+	require.NoError(test, err)
+	_, ok := template.render(body, tag)
+	require.False(test, ok)
+
+	for _, invalid := range []string{"${app", "${}", "${tag[x]}", "${app||service}"} {
+		_, err := parseTypeTemplate(invalid)
+		require.Error(test, err, invalid)
+	}
+}
+
+func TestTemplatedLogType(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_token": testToken,
+		"id":           testId,
+		"logzio_type":  "${kubernetes.labels.app}-${tag[1]}",
+	}, nil)
+	outputs = nil
+	require.NoError(test, initConfigParams(nil))
+	instance := outputs[testId]
+
+	record := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"labels": map[interface{}]interface{}{"app": "checkout"}},
+	}
+	serialized, err := serializeRecord(time.Now(), "kube.prod", record, instance)
+	require.NoError(test, err)
+	var result map[string]interface{}
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, "checkout-prod", result["type"])
+
+	serialized, err = serializeRecord(time.Now(), "kube.prod", map[interface{}]interface{}{"message": "no labels"}, instance)
+	require.NoError(test, err)
+	require.NoError(test, json.Unmarshal(serialized, &result))
+	require.Equal(test, defaultLogType, result["type"])
+
+	plugin = NewTestPluginMock(map[string]string{"logzio_token": testToken, "id": testId, "logzio_type": "${app"}, nil)
+	outputs = nil
+	require.Error(test, initConfigParams(nil))
+}
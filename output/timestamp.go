@@ -0,0 +1,296 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatEpoch   = "epoch"
+	timeFormatEpochMs = "epoch_ms"
+	timeFormatEpochUs = "epoch_us"
+	timeFormatEpochNs = "epoch_ns"
+
+	defaultTimestampKey = "@timestamp"
+
+	timestampFormatRFC3339 = "rfc3339"
+	timestampFormatEpochMs = "epoch_ms"
+
+	timestampPrecisionMs = "ms"
+	timestampPrecisionUs = "us"
+	timestampPrecisionNs = "ns"
+)
+
+// timeParser reads the event time of a record from one of its fields.
+type timeParser struct {
+	key    string
+	format string
+	// layout is the Go layout of a strptime format, e.g. "%d/%b/%Y:%H:%M:%S %z".
+	layout   string
+	location *time.Location
+	keepKey  bool
+}
+
+// loadTimeParser reads the record time parameters. It returns nil when no time key is configured.
+func loadTimeParser(ctx unsafe.Pointer, logger *Logger) (*timeParser, error) {
+	key := strings.TrimSpace(plugin.Environment(ctx, "logzio_time_key"))
+	if key == "" {
+		return nil, nil
+	}
+	parser := &timeParser{key: key, format: timeFormatRFC3339, location: time.UTC, keepKey: true}
+
+	switch format := plugin.Environment(ctx, "logzio_time_format"); {
+	case format == "" || format == timeFormatRFC3339:
+	case format == timeFormatEpoch || format == timeFormatEpochMs || format == timeFormatEpochUs || format == timeFormatEpochNs:
+		parser.format = format
+	case strings.Contains(format, "%"):
+		layout, err := strptimeLayout(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logzio_time_format: %w", err)
+		}
+		parser.format, parser.layout = format, layout
+	default:
+		return nil, fmt.Errorf("invalid logzio_time_format '%s'. Expected rfc3339, epoch, epoch_ms, epoch_us, epoch_ns or a strptime layout", format)
+	}
+
+	if timezone := plugin.Environment(ctx, "logzio_time_timezone"); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logzio_time_timezone: %w", err)
+		}
+		parser.location = location
+	}
+
+	if keepKey := plugin.Environment(ctx, "logzio_time_keep_key"); keepKey != "" {
+		value, err := strconv.ParseBool(keepKey)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Invalid logzio_time_keep_key value '%s'. Using default: true.", keepKey))
+		} else {
+			parser.keepKey = value
+		}
+	}
+	return parser, nil
+}
+
+// parse converts the value of the time field to a time.
+func (parser *timeParser) parse(value interface{}) (time.Time, error) {
+	if parser.layout != "" || parser.format == timeFormatRFC3339 {
+		text, isString := value.(string)
+		if !isString {
+			return time.Time{}, fmt.Errorf("expected a string, got %T", value)
+		}
+		if parser.layout != "" {
+			return time.ParseInLocation(parser.layout, strings.TrimSpace(text), parser.location)
+		}
+		return time.Parse(time.RFC3339Nano, strings.TrimSpace(text))
+	}
+
+	epoch, err := epochValue(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var unit float64
+	switch parser.format {
+	case timeFormatEpoch:
+		unit = float64(time.Second)
+	case timeFormatEpochMs:
+		unit = float64(time.Millisecond)
+	case timeFormatEpochUs:
+		unit = float64(time.Microsecond)
+	default:
+		unit = 1
+	}
+	if integer, isInteger := epoch.(int64); isInteger {
+		if unit == 1 {
+			return time.Unix(0, integer), nil
+		}
+		if math.Abs(float64(integer)) > math.MaxInt64/unit {
+			return time.Time{}, fmt.Errorf("epoch %d is out of range", integer)
+		}
+		return time.Unix(0, integer*int64(unit)), nil
+	}
+	nanos := epoch.(float64) * unit
+	if math.IsNaN(nanos) || math.Abs(nanos) >= math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("epoch %v is out of range", epoch)
+	}
+	return time.Unix(0, int64(nanos)), nil
+}
+
+// epochValue returns a numeric time field value as an int64, or as a float64 when it has a fraction.
+func epochValue(value interface{}) (interface{}, error) {
+	var text string
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("epoch %d is out of range", v)
+		}
+		return int64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		text = v.String()
+	case string:
+		text = strings.TrimSpace(v)
+	default:
+		return nil, fmt.Errorf("expected a number, got %T", value)
+	}
+	if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return integer, nil
+	}
+	float, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not an epoch", text)
+	}
+	return float, nil
+}
+
+// strptimeDirectives maps strptime directives to Go layout elements.
+var strptimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'T': "15:04:05",
+	'F': "2006-01-02",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// strptimeLayout converts a strptime format to a Go layout. %f, the fractional seconds, must follow "%S." or "%S,".
+func strptimeLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i+1 >= len(format) {
+			return "", fmt.Errorf("format '%s' ends with a lone %%", format)
+		}
+		i++
+		if format[i] == 'f' {
+			converted := layout.String()
+			if !strings.HasSuffix(converted, "05.") && !strings.HasSuffix(converted, "05,") {
+				return "", fmt.Errorf("%%f must follow %%S and a separator in '%s'", format)
+			}
+			layout.WriteString("999999999")
+			continue
+		}
+		element, ok := strptimeDirectives[format[i]]
+		if !ok {
+			return "", fmt.Errorf("unsupported directive %%%c in '%s'", format[i], format)
+		}
+		layout.WriteString(element)
+	}
+	return layout.String(), nil
+}
+
+// recordTime returns the time of the record from the configured time field, or the Fluent Bit event time when
+// the field is missing or can't be parsed.
+func (instance *LogzioOutput) recordTime(ts interface{}, body map[string]interface{}) time.Time {
+	parser := instance.timeParser
+	if parser == nil {
+		return formatTimestamp(ts)
+	}
+	value, found := lookupField(body, parser.key)
+	if !found {
+		instance.counters.Add("timestamps.fallback", 1)
+		return formatTimestamp(ts)
+	}
+	timestamp, err := parser.parse(value)
+	if err != nil {
+		instance.counters.Add("timestamps.fallback", 1)
+		instance.logger.Debug(fmt.Sprintf("Failed to parse time field '%s': %v. Using the event time.", parser.key, err))
+		return formatTimestamp(ts)
+	}
+	instance.counters.Add("timestamps.parsed", 1)
+	if !parser.keepKey {
+		removeField(body, parser.key)
+	}
+	return timestamp
+}
+
+// timestampWriter writes the record time to the shipped record. A nil writer writes the time to @timestamp
+// as RFC3339 with nanoseconds.
+type timestampWriter struct {
+	key      string
+	nanosKey string
+	format   string
+	// layout is the RFC3339 layout of the precision, or empty for the default marshaling of time.Time.
+	layout string
+}
+
+// newTimestampWriter reads the timestamp output parameters.
+func newTimestampWriter(ctx unsafe.Pointer, logger *Logger) *timestampWriter {
+	writer := &timestampWriter{
+		key:      strings.TrimSpace(plugin.Environment(ctx, "logzio_timestamp_key")),
+		nanosKey: strings.TrimSpace(plugin.Environment(ctx, "logzio_timestamp_nanos_key")),
+		format:   timestampFormatRFC3339,
+	}
+	if writer.key == "" {
+		writer.key = defaultTimestampKey
+	}
+
+	switch format := plugin.Environment(ctx, "logzio_timestamp_format"); format {
+	case "", timestampFormatRFC3339:
+	case timestampFormatEpochMs:
+		writer.format = format
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_timestamp_format value '%s'. Using default: %s.", format, timestampFormatRFC3339))
+	}
+	switch precision := plugin.Environment(ctx, "logzio_timestamp_precision"); precision {
+	case "", timestampPrecisionNs:
+	case timestampPrecisionMs:
+		writer.layout = "2006-01-02T15:04:05.000Z07:00"
+	case timestampPrecisionUs:
+		writer.layout = "2006-01-02T15:04:05.000000Z07:00"
+	default:
+		logger.Warn(fmt.Sprintf("Invalid logzio_timestamp_precision value '%s'. Using default: %s.", precision, timestampPrecisionNs))
+	}
+	return writer
+}
+
+// write sets the timestamp fields of the record body.
+func (writer *timestampWriter) write(body map[string]interface{}, timestamp time.Time) {
+	if writer == nil {
+		body[defaultTimestampKey] = timestamp
+		return
+	}
+	switch {
+	case writer.format == timestampFormatEpochMs:
+		body[writer.key] = timestamp.UnixMilli()
+	case writer.layout != "":
+		body[writer.key] = timestamp.Format(writer.layout)
+	default:
+		body[writer.key] = timestamp
+	}
+	if writer.nanosKey != "" {
+		body[writer.nanosKey] = timestamp.Nanosecond()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTimeParser(test *testing.T, config map[string]string) *timeParser {
+	plugin = NewTestPluginMock(config, nil)
+	parser, err := loadTimeParser(nil, NewLogger("testTime", false))
+	require.NoError(test, err)
+	return parser
+}
+
+func TestTimeParserFormats(test *testing.T) {
+	expected := time.Date(2024, 3, 5, 14, 7, 9, 123456789, time.UTC)
+
+	cases := []struct {
+		config map[string]string
+		value  interface{}
+	}{
+		{map[string]string{}, "2024-03-05T14:07:09.123456789Z"},
+		{map[string]string{}, "2024-03-05T16:07:09.123456789+02:00"},
+		{map[string]string{"logzio_time_format": "epoch"}, 1709647629.123456789},
+		{map[string]string{"logzio_time_format": "epoch_ns"}, int64(1709647629123456789)},
+		{map[string]string{"logzio_time_format": "epoch_ns"}, json.Number("1709647629123456789")},
+		{map[string]string{"logzio_time_format": "epoch_ns"}, "1709647629123456789"},
+		{map[string]string{"logzio_time_format": "%d/%b/%Y:%H:%M:%S.%f %z"}, "05/Mar/2024:15:07:09.123456789 +0100"},
+		{map[string]string{"logzio_time_format": "%F %T,%f", "logzio_time_timezone": "Asia/Jerusalem"}, "2024-03-05 16:07:09,123456789"},
+	}
+	for _, testCase := range cases {
+		testCase.config["logzio_time_key"] = "time"
+		parsed, err := newTestTimeParser(test, testCase.config).parse(testCase.value)
+		require.NoError(test, err, "%v", testCase.value)
+		// Float epochs lose the sub microsecond digits
+		require.WithinDuration(test, expected, parsed, time.Microsecond, "%v", testCase.value)
+	}
+
+	parser := newTestTimeParser(test, map[string]string{"logzio_time_key": "time", "logzio_time_format": "epoch_ms"})
+	parsed, err := parser.parse(uint64(1709647629123))
+	require.NoError(test, err)
+	require.Equal(test, expected.Truncate(time.Millisecond), parsed.UTC())
+	_, err = parser.parse(int64(1) << 62)
+	require.Error(test, err)
+	_, err = parser.parse("yesterday")
+	require.Error(test, err)
+	_, err = parser.parse(map[string]interface{}{})
+	require.Error(test, err)
+}
+
+func TestTimeParserConfig(test *testing.T) {
+	require.Nil(test, newTestTimeParser(test, map[string]string{}))
+
+	invalid := []map[string]string{
+		{"logzio_time_key": "time", "logzio_time_format": "unix"},
+		{"logzio_time_key": "time", "logzio_time_format": "%Y-%Q"},
+		{"logzio_time_key": "time", "logzio_time_format": "%H:%M:%f"},
+		{"logzio_time_key": "time", "logzio_time_timezone": "Nowhere/City"},
+	}
+	for _, config := range invalid {
+		plugin = NewTestPluginMock(config, nil)
+		_, err := loadTimeParser(nil, NewLogger("testTime", false))
+		require.Error(test, err, "%v", config)
+	}
+}
+
+func TestRecordTime(test *testing.T) {
+	eventTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	instance := &LogzioOutput{
+		logger:     NewLogger("testTime", false),
+		counters:   NewCounters(),
+		timeParser: newTestTimeParser(test, map[string]string{"logzio_time_key": "app.time", "logzio_time_keep_key": "false"}),
+	}
+
+	body := map[string]interface{}{"app": map[string]interface{}{"time": "2024-03-05T14:07:09Z"}, "message": "m"}
+	require.Equal(test, time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC), instance.recordTime(eventTime, body).UTC())
+	require.NotContains(test, body, "app")
+
+	body = map[string]interface{}{"app": map[string]interface{}{"time": "not a time"}}
+	require.Equal(test, eventTime, instance.recordTime(eventTime, body))
+	require.Contains(test, body, "app")
+	require.Equal(test, eventTime, instance.recordTime(eventTime, map[string]interface{}{}))
+
+	require.Equal(test, uint64(1), instance.counters.Get("timestamps.parsed"))
+	require.Equal(test, uint64(2), instance.counters.Get("timestamps.fallback"))
+}
+
+func TestTimestampWriter(test *testing.T) {
+	timestamp := time.Date(2024, 3, 5, 14, 7, 9, 123456789, time.UTC)
+	logger := NewLogger("testTimestamp", false)
+
+	body := map[string]interface{}{}
+	var writer *timestampWriter
+	writer.write(body, timestamp)
+	require.Equal(test, timestamp, body["@timestamp"])
+
+	plugin = NewTestPluginMock(map[string]string{}, nil)
+	serialized, err := marshalTimestamp(newTestTimestampWriter(map[string]string{}, logger), timestamp)
+	require.NoError(test, err)
+	require.JSONEq(test, `{"@timestamp":"2024-03-05T14:07:09.123456789Z"}`, serialized)
+
+	cases := map[string]map[string]string{
+		`{"@timestamp":"2024-03-05T14:07:09.123Z"}`:       {"logzio_timestamp_precision": "ms"},
+		`{"@timestamp":"2024-03-05T14:07:09.123456Z"}`:    {"logzio_timestamp_precision": "us"},
+		`{"time":1709647629123,"time_nanos":123456789}`:   {"logzio_timestamp_format": "epoch_ms", "logzio_timestamp_key": "time", "logzio_timestamp_nanos_key": "time_nanos"},
+		`{"@timestamp":"2024-03-05T14:07:09.123456789Z"}`: {"logzio_timestamp_precision": "ps", "logzio_timestamp_format": "iso"},
+	}
+	for expected, config := range cases {
+		serialized, err := marshalTimestamp(newTestTimestampWriter(config, logger), timestamp)
+		require.NoError(test, err)
+		require.JSONEq(test, expected, serialized, "%v", config)
+	}
+}
+
+func TestFormatTimestampFractionalSeconds(test *testing.T) {
+	require.Equal(test, time.Unix(1709647629, 250000000), formatTimestamp(1709647629.25))
+	require.Equal(test, time.Unix(1709647629, 0), formatTimestamp(uint64(1709647629)))
+	require.Equal(test, time.Unix(1709647629, 0), formatTimestamp(int64(1709647629)))
+}
+
+func newTestTimestampWriter(config map[string]string, logger *Logger) *timestampWriter {
+	plugin = NewTestPluginMock(config, nil)
+	return newTimestampWriter(nil, logger)
+}
+
+func marshalTimestamp(writer *timestampWriter, timestamp time.Time) (string, error) {
+	body := map[string]interface{}{}
+	writer.write(body, timestamp)
+	serialized, err := json.Marshal(body)
+	return string(serialized), err
+}
@@ -0,0 +1,450 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// timeExtType is the msgpack extension type of timestamps.
+const timeExtType = -1
+
+// errNotTranscodable reports a record the transcoder can't write like the record pipeline does, e.g. one with
+// keys that are not strings, or keys that dedot makes equal. Such records are decoded instead.
+var errNotTranscodable = errors.New("record can't be transcoded")
+
+// recordTranscoder writes msgpack records as JSON without decoding them to maps, applying dedot and the added
+// fields on the way. It is only used when no other stage of the record pipeline is configured, see transcodable.
+type recordTranscoder struct {
+	instance *LogzioOutput
+	stream   *jsoniter.Stream
+	hostname string
+	// keys are the keys of the objects being written, to find duplicates.
+	keys []string
+	// dedotted holds the dedotted keys of the record.
+	dedotted []byte
+	// added are the added fields to write after the record fields, and found marks the ones the record has.
+	added         []addedField
+	found         []bool
+	addsType      bool
+	addsHost      bool
+	hasType       bool
+	hasHost       bool
+	invalidFields int
+}
+
+// transcodable reports whether the records of the output can be transcoded.
+func (instance *LogzioOutput) transcodable() bool {
+	if instance.fieldFilter != nil || instance.fieldExpander != nil || instance.logfmtParser != nil ||
+		instance.fieldRenamer != nil || instance.levelNormalizer != nil || instance.timeParser != nil ||
+		instance.redactor != nil || instance.schema != nil || instance.flattener != nil || instance.limits != nil ||
+		instance.keySanitizer != nil || instance.utf8Policy != nil || len(instance.fieldRules) > 0 ||
+		instance.metadataKey != "" || instance.groupKey != "" {
+		return false
+	}
+	for _, outputRoute := range instance.routes() {
+		if outputRoute.ltypeTemplate != nil {
+			return false
+		}
+	}
+	paths := make(map[string]bool, len(instance.addedFields))
+	for _, field := range instance.addedFields {
+		// Nested added fields may merge with record objects
+		if strings.Contains(field.path, ".") || paths[field.path] {
+			return false
+		}
+		paths[field.path] = true
+	}
+	return true
+}
+
+// newRecordTranscoder returns a transcoder for the records of a chunk.
+func (instance *LogzioOutput) newRecordTranscoder() *recordTranscoder {
+	transcoder := &recordTranscoder{
+		instance: instance,
+		stream:   jsoniter.NewStream(jsoniter.ConfigDefault, nil, 4096),
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		instance.logger.Warn(fmt.Sprintf("Could not get hostname: %v. Using 'unknown'.", err))
+		hostname = "unknown_host"
+	}
+	transcoder.hostname = hostname
+
+	for _, field := range instance.addedFields {
+		// The plugin fields overwrite added fields of the same name
+		if transcoder.pluginField(field.path) {
+			continue
+		}
+		transcoder.added = append(transcoder.added, field)
+		transcoder.addsType = transcoder.addsType || field.path == "type"
+		transcoder.addsHost = transcoder.addsHost || field.path == "host"
+	}
+	transcoder.found = make([]bool, len(transcoder.added))
+	return transcoder
+}
+
+// pluginField reports whether the plugin always sets the top level field.
+func (transcoder *recordTranscoder) pluginField(key string) bool {
+	writer := transcoder.instance.timestampWriter
+	switch {
+	case key == "fluentbit_tag", key == "output_id":
+		return true
+	case writer == nil:
+		return key == defaultTimestampKey
+	default:
+		return key == writer.key || (writer.nanosKey != "" && key == writer.nanosKey)
+	}
+}
+
+// transcode serializes the raw record of the event for the route it should be sent to. The returned bytes are
+// only valid until the next call. A panic while transcoding is returned as an error.
+func (transcoder *recordTranscoder) transcode(event logEvent, tag string) (serialized []byte, destination *route, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			serialized, destination, err = nil, nil, fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+	instance := transcoder.instance
+	stream := transcoder.stream
+	stream.Reset(nil)
+	stream.Error = nil
+	transcoder.keys = transcoder.keys[:0]
+	transcoder.dedotted = transcoder.dedotted[:0]
+	transcoder.hasType, transcoder.hasHost, transcoder.invalidFields = false, false, 0
+	for i := range transcoder.found {
+		transcoder.found[i] = false
+	}
+
+	reader := msgpackReader{data: event.raw}
+	token, err := reader.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.kind != msgpackMap {
+		return nil, nil, errNotTranscodable
+	}
+	stream.WriteObjectStart()
+	written, err := transcoder.writeFields(&reader, token.length, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, field := range transcoder.added {
+		if !transcoder.found[i] {
+			transcoder.writeKey(field.path, &written)
+			stream.WriteStringWithHTMLEscaped(field.value)
+		}
+	}
+	destination = instance.routeForTag(tag)
+	if !transcoder.hasType && !transcoder.addsType {
+		transcoder.writeKey("type", &written)
+		stream.WriteStringWithHTMLEscaped(destination.logType(nil, tag))
+	}
+	if err := transcoder.writeTimestamp(formatTimestamp(event.timestamp), &written); err != nil {
+		return nil, nil, err
+	}
+	transcoder.writeKey("fluentbit_tag", &written)
+	stream.WriteStringWithHTMLEscaped(tag)
+	transcoder.writeKey("output_id", &written)
+	stream.WriteStringWithHTMLEscaped(instance.id)
+	if !transcoder.hasHost && !transcoder.addsHost {
+		transcoder.writeKey("host", &written)
+		stream.WriteStringWithHTMLEscaped(transcoder.hostname)
+	}
+	stream.WriteObjectEnd()
+	if stream.Error != nil {
+		return nil, nil, fmt.Errorf("failed marshal record: %w", stream.Error)
+	}
+
+	instance.counters.Add("route."+destination.name+".records", 1)
+	if transcoder.invalidFields > 0 {
+		instance.counters.Add("records.invalid_utf8", 1)
+		instance.counters.Add("fields.invalid_utf8", transcoder.invalidFields)
+	}
+	return stream.Buffer(), destination, nil
+}
+
+// writeFields writes the fields of a map of length entries, without its braces, and returns the number of
+// fields written. Fields that the plugin sets are left out of the record root.
+func (transcoder *recordTranscoder) writeFields(reader *msgpackReader, length int, root bool) (int, error) {
+	instance := transcoder.instance
+	dedot := instance.dedotEnabled && (root || instance.dedotNested)
+	keysStart := len(transcoder.keys)
+	written := 0
+	for i := 0; i < length; i++ {
+		token, err := reader.next()
+		if err != nil {
+			return 0, err
+		}
+		if token.kind != msgpackString && token.kind != msgpackBinary {
+			return 0, errNotTranscodable
+		}
+		key := bytesString(token.bytes)
+		if !utf8.ValidString(key) {
+			key = strings.ToValidUTF8(key, "\uFFFD")
+		}
+		if dedot && strings.IndexByte(key, '.') >= 0 {
+			key = transcoder.dedot(key)
+		}
+		transcoder.keys = append(transcoder.keys, key)
+
+		if root && transcoder.skipRootField(key) {
+			if err := reader.skip(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		transcoder.writeKey(key, &written)
+		if err := transcoder.writeValue(reader); err != nil {
+			return 0, err
+		}
+	}
+	// A decoded map keeps one of the fields with the same key
+	if hasDuplicateKey(transcoder.keys[keysStart:]) {
+		return 0, errNotTranscodable
+	}
+	transcoder.keys = transcoder.keys[:keysStart]
+	return written, nil
+}
+
+// skipRootField reports whether a top level field of the record is replaced by a plugin or an added field.
+func (transcoder *recordTranscoder) skipRootField(key string) bool {
+	if transcoder.pluginField(key) {
+		return true
+	}
+	switch key {
+	case "type":
+		transcoder.hasType = true
+	case "host":
+		transcoder.hasHost = true
+	}
+	for i, field := range transcoder.added {
+		if field.path == key {
+			if transcoder.instance.addFieldsOverwrite {
+				return true
+			}
+			transcoder.found[i] = true
+		}
+	}
+	return false
+}
+
+// dedot replaces the dots of the key with the dedot separator.
+func (transcoder *recordTranscoder) dedot(key string) string {
+	start := len(transcoder.dedotted)
+	separator := transcoder.instance.dedotNewSeparator
+	for i := 0; i < len(key); i++ {
+		if key[i] == '.' {
+			transcoder.dedotted = append(transcoder.dedotted, separator...)
+		} else {
+			transcoder.dedotted = append(transcoder.dedotted, key[i])
+		}
+	}
+	// Growing the buffer copies it, so the keys returned before still point to their unchanged bytes
+	return bytesString(transcoder.dedotted[start:])
+}
+
+func (transcoder *recordTranscoder) writeKey(key string, written *int) {
+	if *written > 0 {
+		transcoder.stream.WriteMore()
+	}
+	*written++
+	transcoder.stream.WriteStringWithHTMLEscaped(key)
+	transcoder.stream.WriteRaw(":")
+}
+
+// writeValue writes the next value like jsonScalar and the record parser convert it.
+func (transcoder *recordTranscoder) writeValue(reader *msgpackReader) error {
+	stream := transcoder.stream
+	token, err := reader.next()
+	if err != nil {
+		return err
+	}
+	switch token.kind {
+	case msgpackNil:
+		stream.WriteNil()
+	case msgpackBool:
+		stream.WriteBool(token.boolean)
+	case msgpackInt:
+		stream.WriteInt64(token.int)
+	case msgpackUint:
+		if token.uint > math.MaxInt64 {
+			stream.WriteRaw(`"`)
+			stream.WriteUint64(token.uint)
+			stream.WriteRaw(`"`)
+		} else {
+			stream.WriteUint64(token.uint)
+		}
+	case msgpackFloat:
+		if math.IsNaN(token.float) || math.IsInf(token.float, 0) {
+			stream.WriteString(floatString(token.float))
+		} else {
+			stream.WriteFloat64(token.float)
+		}
+	case msgpackString, msgpackBinary:
+		text := bytesString(token.bytes)
+		if !utf8.ValidString(text) {
+			transcoder.invalidFields++
+			text = strings.ToValidUTF8(text, "\uFFFD")
+		}
+		stream.WriteStringWithHTMLEscaped(text)
+	case msgpackArray:
+		if token.length == 0 {
+			// The record parser converts empty arrays to nil slices
+			stream.WriteNil()
+			return nil
+		}
+		stream.WriteArrayStart()
+		for i := 0; i < token.length; i++ {
+			if i > 0 {
+				stream.WriteMore()
+			}
+			if err := transcoder.writeValue(reader); err != nil {
+				return err
+			}
+		}
+		stream.WriteArrayEnd()
+	case msgpackMap:
+		stream.WriteObjectStart()
+		if _, err := transcoder.writeFields(reader, token.length, false); err != nil {
+			return err
+		}
+		stream.WriteObjectEnd()
+	case msgpackExt:
+		return transcoder.writeExt(token)
+	}
+	return nil
+}
+
+// writeExt writes EventTime and timestamp extensions as times, and other extensions as
+// {"ext": <type>, "data": "<base64>"}.
+func (transcoder *recordTranscoder) writeExt(token msgpackToken) error {
+	stream := transcoder.stream
+	switch token.extType {
+	case eventTimeExtType:
+		var t eventTime
+		t.ReadExt(&t, token.bytes)
+		if !t.valid {
+			stream.WriteNil()
+			return nil
+		}
+		return transcoder.writeTime(t.Time, time.RFC3339Nano)
+	case timeExtType:
+		var t time.Time
+		switch data := token.bytes; len(data) {
+		case 4:
+			t = time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC()
+		case 8:
+			value := binary.BigEndian.Uint64(data)
+			t = time.Unix(int64(value&0x00000003ffffffff), int64(value>>34)).UTC()
+		case 12:
+			t = time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data))).UTC()
+		default:
+			return errNotTranscodable
+		}
+		return transcoder.writeTime(t, time.RFC3339Nano)
+	}
+	stream.WriteObjectStart()
+	stream.WriteObjectField("ext")
+	stream.WriteUint8(uint8(token.extType))
+	stream.WriteMore()
+	stream.WriteObjectField("data")
+	buffer := append(stream.Buffer(), '"')
+	buffer = base64.StdEncoding.AppendEncode(buffer, token.bytes)
+	stream.SetBuffer(append(buffer, '"'))
+	stream.WriteObjectEnd()
+	return nil
+}
+
+// writeTimestamp writes the record time like the timestamp writer.
+func (transcoder *recordTranscoder) writeTimestamp(timestamp time.Time, written *int) error {
+	writer := transcoder.instance.timestampWriter
+	if writer == nil {
+		transcoder.writeKey(defaultTimestampKey, written)
+		return transcoder.writeTime(timestamp, time.RFC3339Nano)
+	}
+	transcoder.writeKey(writer.key, written)
+	switch {
+	case writer.format == timestampFormatEpochMs:
+		transcoder.stream.WriteInt64(timestamp.UnixMilli())
+	case writer.layout != "":
+		transcoder.appendTime(timestamp, writer.layout)
+	default:
+		if err := transcoder.writeTime(timestamp, time.RFC3339Nano); err != nil {
+			return err
+		}
+	}
+	if writer.nanosKey != "" {
+		transcoder.writeKey(writer.nanosKey, written)
+		transcoder.stream.WriteInt(timestamp.Nanosecond())
+	}
+	return nil
+}
+
+// writeTime writes a time like its JSON marshaling does.
+func (transcoder *recordTranscoder) writeTime(t time.Time, layout string) error {
+	if year := t.Year(); year < 0 || year > 9999 {
+		return fmt.Errorf("failed marshal record: year %d outside of range [0,9999]", year)
+	}
+	transcoder.appendTime(t, layout)
+	return nil
+}
+
+func (transcoder *recordTranscoder) appendTime(t time.Time, layout string) {
+	buffer := append(transcoder.stream.Buffer(), '"')
+	buffer = t.AppendFormat(buffer, layout)
+	transcoder.stream.SetBuffer(append(buffer, '"'))
+}
+
+// hasDuplicateKey reports whether two of the keys are equal. Small objects are checked without allocating.
+func hasDuplicateKey(keys []string) bool {
+	if len(keys) <= 32 {
+		for i := 1; i < len(keys); i++ {
+			for j := 0; j < i; j++ {
+				if keys[i] == keys[j] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			return true
+		}
+		seen[key] = true
+	}
+	return false
+}
+
+// serializeEvent serializes an event of a chunk. A record the decoder left encoded is transcoded,
+// or decoded when the transcoder can't write it.
+func (instance *LogzioOutput) serializeEvent(decoder *eventDecoder, transcoder *recordTranscoder, event logEvent, tag string) ([]byte, *route, error) {
+	if event.record == nil && event.raw != nil {
+		if transcoder != nil {
+			serialized, destination, err := transcoder.transcode(event, tag)
+			if err != errNotTranscodable {
+				return serialized, destination, err
+			}
+		}
+		var err error
+		if event.record, err = decoder.decodeMap(event.raw); err != nil {
+			return nil, nil, err
+		}
+	}
+	instance.attachEventMetadata(event)
+	return serializeRoutedRecord(event.timestamp, tag, event.record, instance)
+}
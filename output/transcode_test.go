@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"testing"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func transcodeTestChunk(test *testing.T) []byte {
+	return encodeTestChunk(test,
+		[]interface{}{testEventTime(1709647629, 123456789), map[string]interface{}{
+			"message":        "GET /index.html <b>&</b>",
+			"log.level":      "info",
+			"kubernetes":     map[string]interface{}{"labels": map[string]interface{}{"app.kubernetes.io/name": "web"}, "pod": "web-1"},
+			"status":         200,
+			"negative":       -42,
+			"latency":        0.25,
+			"tiny":           1e-9,
+			"ratio":          float32(0.1),
+			"huge":           uint64(math.MaxUint64),
+			"nan":            math.NaN(),
+			"empty":          []interface{}{},
+			"tags":           []interface{}{"a", 1, nil, true, map[string]interface{}{"x.y": "z"}},
+			"binary":         []byte("bytes"),
+			"invalid":        "bad \xff\xfe value",
+			"ext":            codec.RawExt{Tag: 5, Data: []byte{1, 2, 3}},
+			"event_time":     testEventTime(1709647630, 5),
+			"empty_object":   map[string]interface{}{},
+			"team":           "record",
+			"@timestamp":     "replaced",
+			"fluentbit_tag":  "replaced",
+			"escaped\"key\n": "value",
+		}},
+		[]interface{}{uint64(1709647631), map[string]interface{}{"message": "seconds", "type": "custom", "host": "record-host"}},
+		[]interface{}{[]interface{}{testEventTime(1709647632, 0), map[string]interface{}{}}, map[string]interface{}{"message": "v2"}},
+	)
+}
+
+func transcodeTestInstance() *LogzioOutput {
+	return &LogzioOutput{
+		logger:            NewLogger("testTranscode", false),
+		ltype:             "transcoded",
+		id:                "out1",
+		dedotNewSeparator: "_",
+		counters:          NewCounters(),
+	}
+}
+
+func TestTranscodeMatchesDecodedRecords(test *testing.T) {
+	chunk := transcodeTestChunk(test)
+	configs := map[string]func(instance *LogzioOutput){
+		"default": func(instance *LogzioOutput) {},
+		"dedot": func(instance *LogzioOutput) {
+			instance.dedotEnabled = true
+		},
+		"dedot nested": func(instance *LogzioOutput) {
+			instance.dedotEnabled, instance.dedotNested, instance.dedotNewSeparator = true, true, "__"
+		},
+		"added fields": func(instance *LogzioOutput) {
+			instance.addedFields = []addedField{{path: "team", value: "added"}, {path: "env", value: "prod"}, {path: "host", value: "added-host"}}
+		},
+		"added fields overwrite": func(instance *LogzioOutput) {
+			instance.addedFields = []addedField{{path: "team", value: "added"}, {path: "type", value: "added-type"}}
+			instance.addFieldsOverwrite = true
+		},
+		"timestamp writer": func(instance *LogzioOutput) {
+			instance.timestampWriter = &timestampWriter{key: "time", nanosKey: "time_nanos", layout: "2006-01-02T15:04:05.000Z07:00"}
+		},
+		"epoch timestamp": func(instance *LogzioOutput) {
+			instance.timestampWriter = &timestampWriter{key: defaultTimestampKey, format: timestampFormatEpochMs}
+		},
+	}
+
+	for name, configure := range configs {
+		test.Run(name, func(test *testing.T) {
+			instance := transcodeTestInstance()
+			configure(instance)
+			require.True(test, instance.transcodable())
+			transcoder := instance.newRecordTranscoder()
+
+			lazy, decoded := newEventDecoder(chunk), newEventDecoder(chunk)
+			lazy.lazy = true
+			for {
+				event, err := lazy.next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(test, err)
+				require.Nil(test, event.record)
+				transcoded, destination, err := transcoder.transcode(event, "app.web")
+				require.NoError(test, err)
+				require.Equal(test, defaultRouteName, destination.name)
+
+				decodedEvent, err := decoded.next()
+				require.NoError(test, err)
+				configured := transcodeTestInstance()
+				configure(configured)
+				expected, _, err := serializeRoutedRecord(decodedEvent.timestamp, "app.web", decodedEvent.record, configured)
+				require.NoError(test, err)
+				require.JSONEq(test, string(expected), string(transcoded))
+			}
+			require.Equal(test, uint64(1), instance.counters.Get("records.invalid_utf8"))
+		})
+	}
+}
+
+func TestTranscodeFallsBackToDecoding(test *testing.T) {
+	instance := transcodeTestInstance()
+	instance.dedotEnabled = true
+	chunk := encodeTestChunk(test,
+		// Dedot makes both keys "a_b"
+		[]interface{}{uint64(1709647629), map[string]interface{}{"a.b": "dotted", "a_b": "plain"}},
+		[]interface{}{uint64(1709647629), map[interface{}]interface{}{1: "integer key"}},
+		[]interface{}{uint64(1709647629), map[string]interface{}{"nested": map[interface{}]interface{}{true: "boolean key"}}},
+	)
+	transcoder := instance.newRecordTranscoder()
+	decoder := newEventDecoder(chunk)
+	decoder.lazy = true
+	for i := 0; i < 3; i++ {
+		event, err := decoder.next()
+		require.NoError(test, err)
+		_, _, err = transcoder.transcode(event, "tag")
+		require.Equal(test, errNotTranscodable, err)
+
+		serialized, _, err := instance.serializeEvent(decoder, transcoder, event, "tag")
+		require.NoError(test, err)
+		var result map[string]interface{}
+		require.NoError(test, json.Unmarshal(serialized, &result))
+		require.Equal(test, "tag", result["fluentbit_tag"])
+	}
+}
+
+func TestTranscodable(test *testing.T) {
+	require.True(test, transcodeTestInstance().transcodable())
+
+	instance := transcodeTestInstance()
+	instance.redactor = &redactor{}
+	require.False(test, instance.transcodable())
+
+	instance = transcodeTestInstance()
+	instance.addedFields = []addedField{{path: "meta.region", value: "us"}}
+	require.False(test, instance.transcodable())
+
+	instance = transcodeTestInstance()
+	instance.metadataKey = "metadata"
+	require.False(test, instance.transcodable())
+
+	instance = transcodeTestInstance()
+	template, err := compileLogType("${service}")
+	require.NoError(test, err)
+	instance.mainRoute = &route{name: defaultRouteName, ltype: "fallback", ltypeTemplate: template}
+	require.False(test, instance.transcodable())
+}
+
+// benchmarkChunk returns a chunk of 1000 records of a Kubernetes container log.
+func benchmarkChunk(b *testing.B) ([]byte, int) {
+	entry := []interface{}{testEventTime(1709647629, 0), map[string]interface{}{
+		"log":        "2024-03-05T14:07:09.123Z INFO request served in 12ms",
+		"stream":     "stdout",
+		"log.level":  "info",
+		"status":     200,
+		"latency_ms": 12.5,
+		"kubernetes": map[string]interface{}{
+			"pod_name":       "web-6d4cf56db6-2xk8p",
+			"namespace_name": "default",
+			"container_name": "web",
+			"labels":         map[string]interface{}{"app": "web", "pod-template-hash": "6d4cf56db6"},
+		},
+	}}
+	entries := make([]interface{}, 1000)
+	for i := range entries {
+		entries[i] = entry
+	}
+	return encodeTestChunk(b, entries...), len(entries)
+}
+
+// benchmarkFlush serializes one record per iteration, the way a flush does.
+func benchmarkFlush(b *testing.B, transcode bool) {
+	instance := transcodeTestInstance()
+	instance.dedotEnabled = true
+	instance.addedFields = []addedField{{path: "env", value: "prod"}}
+	instance.mainRoute = instance.defaultRoute()
+	chunk, records := benchmarkChunk(b)
+
+	var decoder *eventDecoder
+	var transcoder *recordTranscoder
+	if transcode {
+		transcoder = instance.newRecordTranscoder()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%records == 0 {
+			decoder = newEventDecoder(chunk)
+			decoder.lazy = transcode
+		}
+		event, err := decoder.next()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := instance.serializeEvent(decoder, transcoder, event, "kube.web"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFlushDecodedRecord(b *testing.B) {
+	benchmarkFlush(b, false)
+}
+
+func BenchmarkFlushTranscodedRecord(b *testing.B) {
+	benchmarkFlush(b, true)
+}
+
+// baselineParseJSON is parseJSON as it was before the record pipeline, which compiled the dedot regex for every key.
+// The array case is left out, as the benchmark records have no arrays.
+func baselineParseJSON(record map[interface{}]interface{}, dedotEnabled bool, dedotNested bool, dedotNewSeparator string) map[string]interface{} {
+	jsonRecord := make(map[string]interface{})
+	for k, v := range record {
+		stringKey := k.(string)
+		if dedotEnabled {
+			regex := regexp.MustCompile("\\.")
+			stringKey = regex.ReplaceAllString(stringKey, dedotNewSeparator)
+		}
+		switch t := v.(type) {
+		case []byte:
+			jsonRecord[stringKey] = string(t)
+		case map[interface{}]interface{}:
+			jsonRecord[stringKey] = baselineParseJSON(t, dedotEnabled && dedotNested, dedotNested, dedotNewSeparator)
+		default:
+			jsonRecord[stringKey] = v
+		}
+	}
+	return jsonRecord
+}
+
+// BenchmarkFlushBaselineRecord measures the flush path before the record pipeline, which decoded records with
+// output.GetRecord and serialized them with baselineParseJSON, for comparison with the benchmarks above. It adds
+// the same env field, so all three write the same record.
+func BenchmarkFlushBaselineRecord(b *testing.B) {
+	instance := transcodeTestInstance()
+	chunk, records := benchmarkChunk(b)
+
+	var decoder *output.FLBDecoder
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%records == 0 {
+			decoder = output.NewDecoder(unsafe.Pointer(&chunk[0]), len(chunk))
+		}
+		ret, ts, record := output.GetRecord(decoder)
+		if ret != 0 {
+			b.Fatalf("failed to decode record %d", i%records)
+		}
+		body := baselineParseJSON(record, true, false, "_")
+		body["@timestamp"] = formatTimestamp(ts)
+		body["fluentbit_tag"] = "kube.web"
+		body["type"] = instance.ltype
+		body["output_id"] = instance.id
+		body["env"] = "prod"
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown_host"
+		}
+		body["host"] = hostname
+		if _, err := jsoniter.Marshal(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
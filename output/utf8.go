@@ -0,0 +1,142 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+const (
+	// invalidUTF8Replace replaces invalid byte sequences with U+FFFD
+	invalidUTF8Replace = "replace"
+	// invalidUTF8Escape replaces every invalid byte with its \xNN escape
+	invalidUTF8Escape = "escape"
+	// invalidUTF8Base64 ships the base64 of the value in a sibling field named <field>_base64, instead of the field
+	invalidUTF8Base64 = "base64"
+	// invalidUTF8Drop removes the field
+	invalidUTF8Drop = "drop"
+
+	base64FieldSuffix = "_base64"
+)
+
+// utf8Rule applies an invalid UTF-8 action to the fields matching its dotted path pattern.
+type utf8Rule struct {
+	pattern []string
+	action  string
+}
+
+// utf8Policy decides what happens to string and binary values that are not valid UTF-8.
+// A nil policy replaces invalid sequences.
+type utf8Policy struct {
+	action string
+	rules  []utf8Rule
+}
+
+// loadUTF8Policy reads the global action and the "field1:action1,field2:action2" per field actions.
+// It returns nil for the default policy.
+func loadUTF8Policy(ctx unsafe.Pointer, logger *Logger) *utf8Policy {
+	policy := &utf8Policy{action: invalidUTF8Replace}
+	if action := plugin.Environment(ctx, "logzio_invalid_utf8"); action != "" {
+		if isUTF8Action(action) {
+			policy.action = action
+		} else {
+			logger.Warn(fmt.Sprintf("Invalid logzio_invalid_utf8 value '%s'. Using default: %s.", action, invalidUTF8Replace))
+		}
+	}
+
+	for _, pair := range strings.Split(plugin.Environment(ctx, "logzio_invalid_utf8_fields"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || !isUTF8Action(strings.TrimSpace(parts[1])) {
+			logger.Warn(fmt.Sprintf("Warning: malformed rule '%s' in logzio_invalid_utf8_fields. Expected format 'field:replace|escape|base64|drop'", pair))
+			continue
+		}
+		policy.rules = append(policy.rules, utf8Rule{
+			pattern: strings.Split(strings.TrimSpace(parts[0]), "."),
+			action:  strings.TrimSpace(parts[1]),
+		})
+	}
+
+	if policy.action == invalidUTF8Replace && len(policy.rules) == 0 {
+		return nil
+	}
+	return policy
+}
+
+func isUTF8Action(action string) bool {
+	switch action {
+	case invalidUTF8Replace, invalidUTF8Escape, invalidUTF8Base64, invalidUTF8Drop:
+		return true
+	}
+	return false
+}
+
+// hasRules reports whether the action depends on the field path.
+func (policy *utf8Policy) hasRules() bool {
+	return policy != nil && len(policy.rules) > 0
+}
+
+// actionFor returns the action of the field at path. Rules are checked in order before the global action.
+func (policy *utf8Policy) actionFor(path []string) string {
+	if policy == nil {
+		return invalidUTF8Replace
+	}
+	for _, rule := range policy.rules {
+		if len(rule.pattern) == len(path) && matchSegments(rule.pattern, path) {
+			return rule.action
+		}
+	}
+	return policy.action
+}
+
+// validText converts invalid UTF-8 text with the replace or escape action.
+func validText(text string, action string) string {
+	if action != invalidUTF8Escape {
+		return strings.ToValidUTF8(text, "\uFFFD")
+	}
+	var builder strings.Builder
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&builder, `\x%02x`, text[i])
+		} else {
+			builder.WriteString(text[i : i+size])
+		}
+		i += size
+	}
+	return builder.String()
+}
+
+// sanitizeField applies the invalid UTF-8 policy to a converted map value. It returns the value to store under key,
+// whether to store it, and an optional sibling field holding the base64 of the value.
+func (parser *recordParser) sanitizeField(value interface{}, path []string) (sanitized interface{}, keep bool, base64Value string) {
+	text, isText := value.(string)
+	if !isText || utf8.ValidString(text) {
+		return value, true, ""
+	}
+	parser.invalidUTF8Fields++
+	switch action := parser.utf8.actionFor(path); action {
+	case invalidUTF8Drop:
+		return nil, false, ""
+	case invalidUTF8Base64:
+		return nil, false, base64.StdEncoding.EncodeToString([]byte(text))
+	default:
+		return validText(text, action), true, ""
+	}
+}
+
+// sanitizeElement applies the invalid UTF-8 policy to an array element. The base64 action encodes the element in place.
+func (parser *recordParser) sanitizeElement(value interface{}, path []string) (interface{}, bool) {
+	sanitized, keep, base64Value := parser.sanitizeField(value, path)
+	if base64Value != "" {
+		return base64Value, true
+	}
+	return sanitized, keep
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidUTF8DefaultPolicy(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{}, nil)
+	require.Nil(test, loadUTF8Policy(nil, NewLogger("testUTF8", false)))
+
+	parser := &recordParser{}
+	body := parseJSON(map[interface{}]interface{}{
+		"valid":      []byte("héllo"),
+		"invalid":    "bad\xff\xfebytes",
+		"binary":     []byte{0x00, 0x80, 'a'},
+		"array":      []interface{}{"ok", "x\xc3"},
+		"bad\xffkey": "value",
+	}, parser)
+	require.Equal(test, map[string]interface{}{
+		"valid":   "héllo",
+		"invalid": "bad�bytes",
+		"binary":  "\x00�a",
+		"array":   []interface{}{"ok", "x�"},
+		"bad�key": "value",
+	}, body)
+	require.Equal(test, 3, parser.invalidUTF8Fields)
+}
+
+func TestInvalidUTF8Policies(test *testing.T) {
+	plugin = NewTestPluginMock(map[string]string{
+		"logzio_invalid_utf8":        "escape",
+		"logzio_invalid_utf8_fields": "payload:base64,nested.*:drop,list:base64,broken,other:unknown",
+	}, nil)
+	policy := loadUTF8Policy(nil, NewLogger("testUTF8", false))
+	require.Len(test, policy.rules, 3)
+
+	parser := &recordParser{utf8: policy}
+	body := parseJSON(map[interface{}]interface{}{
+		"message": "a\xffb",
+		"payload": []byte{0xde, 0xad, 0xbe, 0xef},
+		"nested":  map[interface{}]interface{}{"secret": "\xff", "text": "ok"},
+		"list":    []interface{}{"\xff", "ok"},
+	}, parser)
+	require.Equal(test, map[string]interface{}{
+		"message":        `a\xffb`,
+		"payload_base64": "3q2+7w==",
+		"nested":         map[string]interface{}{"text": "ok"},
+		"list":           []interface{}{"/w==", "ok"},
+	}, body)
+	require.Equal(test, 4, parser.invalidUTF8Fields)
+}
+
+func TestInvalidUTF8RecordCounters(test *testing.T) {
+	instance := &LogzioOutput{logger: NewLogger("testUTF8", false), ltype: "type1", id: "out1", counters: NewCounters()}
+	_, err := serializeRecord(time.Now(), "tag", map[interface{}]interface{}{"a": "\xff", "b": "\xfe"}, instance)
+	require.NoError(test, err)
+	_, err = serializeRecord(time.Now(), "tag", map[interface{}]interface{}{"a": "valid"}, instance)
+	require.NoError(test, err)
+	require.Equal(test, uint64(1), instance.counters.Get("records.invalid_utf8"))
+	require.Equal(test, uint64(2), instance.counters.Get("fields.invalid_utf8"))
+}
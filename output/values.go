@@ -0,0 +1,98 @@
+//go:build linux || darwin || windows
+// +build linux darwin windows
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// keyString converts a msgpack map key to a JSON object key. Keys that are not strings are formatted
+// as their JSON value, e.g. the key 1 becomes "1" and nil becomes "null".
+func keyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(k)
+	case int64:
+		return strconv.FormatInt(k, 10)
+	case uint64:
+		return strconv.FormatUint(k, 10)
+	case float64:
+		return floatString(k)
+	default:
+		value := jsonScalar(key)
+		if text, isText := value.(string); isText {
+			return text
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+// jsonScalar converts a msgpack value that is not a map, an array or a byte string to a value that can always
+// be marshaled to JSON:
+//   - integers above the largest signed 64 bit integer become decimal strings, as Logz.io can't index them as numbers
+//   - NaN and infinite floats become the strings "NaN", "+Inf" and "-Inf"
+//   - EventTime extensions become times, and other extensions become {"ext": <type>, "data": "<base64>"}
+//   - values of any other type become their Go formatting
+func jsonScalar(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, string, int64, int, int32, int16, int8, uint32, uint16, uint8, time.Time, json.Number:
+		return v
+	case uint64:
+		if v > math.MaxInt64 {
+			return strconv.FormatUint(v, 10)
+		}
+		return v
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return strconv.FormatUint(uint64(v), 10)
+		}
+		return v
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return floatString(v)
+		}
+		return v
+	case float32:
+		return jsonScalar(float64(v))
+	case eventTime:
+		if !v.valid {
+			return nil
+		}
+		return v.Time
+	case codec.RawExt:
+		return map[string]interface{}{"ext": v.Tag, "data": base64.StdEncoding.EncodeToString(v.Data)}
+	default:
+		if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func floatString(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestSerializeExoticValues(test *testing.T) {
+	instance := &LogzioOutput{logger: NewLogger("testValues", false), ltype: "type1", id: "out1"}
+	var nilPointer *int
+	record := map[interface{}]interface{}{
+		int64(1):     "int key",
+		uint64(2):    "uint key",
+		nil:          "nil key",
+		true:         "bool key",
+		1.5:          "float key",
+		"big":        uint64(math.MaxUint64),
+		"small":      uint64(42),
+		"nan":        math.NaN(),
+		"inf":        math.Inf(1),
+		"negInf":     float32(math.Inf(-1)),
+		"nil":        nil,
+		"nilPointer": nilPointer,
+		"ext":        codec.RawExt{Tag: 7, Data: []byte{1, 2, 3}},
+		"eventTime":  eventTime{Time: time.Unix(1709647629, 0).UTC(), valid: true},
+		"badTime":    eventTime{},
+		"channel":    make(chan int),
+		"nested":     map[interface{}]interface{}{int64(-3): []interface{}{math.NaN(), uint64(math.MaxUint64)}},
+		"stringMap":  map[string]interface{}{"inner": math.Inf(-1)},
+	}
+
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	body := make(map[string]interface{})
+	require.NoError(test, json.Unmarshal(serialized, &body))
+
+	require.Equal(test, "int key", body["1"])
+	require.Equal(test, "uint key", body["2"])
+	require.Equal(test, "nil key", body["null"])
+	require.Equal(test, "bool key", body["true"])
+	require.Equal(test, "float key", body["1.5"])
+	require.Equal(test, "18446744073709551615", body["big"])
+	require.Equal(test, float64(42), body["small"])
+	require.Equal(test, "NaN", body["nan"])
+	require.Equal(test, "+Inf", body["inf"])
+	require.Equal(test, "-Inf", body["negInf"])
+	require.Contains(test, body, "nil")
+	require.Nil(test, body["nil"])
+	require.Nil(test, body["nilPointer"])
+	require.Equal(test, map[string]interface{}{"ext": float64(7), "data": "AQID"}, body["ext"])
+	require.Equal(test, "2024-03-05T14:07:09Z", body["eventTime"])
+	require.Nil(test, body["badTime"])
+	require.IsType(test, "", body["channel"])
+	require.Equal(test, map[string]interface{}{"-3": []interface{}{"NaN", "18446744073709551615"}}, body["nested"])
+	require.Equal(test, map[string]interface{}{"inner": "-Inf"}, body["stringMap"])
+}
+
+func TestSerializeBinaryKeys(test *testing.T) {
+	// {bin("bin"): "v", 1: bin("x")}
+	chunk := []byte{0x82, 0xc4, 0x03, 'b', 'i', 'n', 0xa1, 'v', 0x01, 0xc4, 0x01, 'x'}
+	var record map[interface{}]interface{}
+	require.NoError(test, codec.NewDecoderBytes(chunk, eventHandle).Decode(&record))
+
+	instance := &LogzioOutput{logger: NewLogger("testValues", false), ltype: "type1", id: "out1"}
+	serialized, err := serializeRecord(time.Now(), "tag", record, instance)
+	require.NoError(test, err)
+	body := make(map[string]interface{})
+	require.NoError(test, json.Unmarshal(serialized, &body))
+	require.Equal(test, "v", body["bin"])
+	require.Equal(test, "x", body["1"])
+}
+
+func TestSerializeRecoversFromPanic(test *testing.T) {
+	serialized, destination, err := serializeRoutedRecord(time.Now(), "tag", map[interface{}]interface{}{"key": "value"}, nil)
+	require.Error(test, err)
+	require.Nil(test, serialized)
+	require.Nil(test, destination)
+}